@@ -0,0 +1,261 @@
+package bookapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Audit log operations
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditChange is the value of one book field before and after a change
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Op        string                 `json:"op"`
+	BookID    string                 `json:"bookId"`
+	Diff      map[string]AuditChange `json:"diff"`
+}
+
+// AuditLog appends an AuditEntry per change as a JSON line. Writes are
+// serialized, and a writer that can sync (such as a file) is synced before
+// Record returns.
+type AuditLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	clock Clock
+	// For logs opened with OpenAuditLog, reader reads the file back for
+	// History. index locates each book's entries in it, size is the
+	// length of the file, and torn reports that it ends in part of a line
+	// left by a failed write; all are guarded by mu.
+	reader *os.File
+	index  map[string][]auditSpan
+	size   int64
+	torn   bool
+}
+
+// auditSpan is the position of one entry in the audit log file
+type auditSpan struct {
+	offset int64
+	length int
+}
+
+// AuditOption configures an AuditLog
+type AuditOption func(*AuditLog)
+
+// WithAuditClock sets the clock that stamps entries, normally the one the
+// repository stamps books with
+func WithAuditClock(c Clock) AuditOption {
+	return func(a *AuditLog) {
+		a.clock = c
+	}
+}
+
+// NewAuditLog creates an audit log writing to w
+func NewAuditLog(w io.Writer, opts ...AuditOption) *AuditLog {
+	a := &AuditLog{w: w, clock: realClock{}}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// OpenAuditLog opens path for appending, creating it if needed, so the
+// history survives restarts. The existing entries are indexed by book
+// once, so History reads only the entries it returns.
+func OpenAuditLog(path string, opts ...AuditOption) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := os.Open(path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := NewAuditLog(f, opts...)
+	a.reader = reader
+	a.index = make(map[string][]auditSpan)
+	// A line torn by a crash is ended by the next entry
+	a.torn, err = a.indexEntries()
+	if err != nil {
+		f.Close()
+		reader.Close()
+		return nil, fmt.Errorf("indexing %s: %w", path, err)
+	}
+	return a, nil
+}
+
+// indexEntries records the position of every entry in the file and sets
+// size to its end. torn reports a last line without a newline, left by a
+// crash mid-write, which is not indexed.
+func (a *AuditLog) indexEntries() (torn bool, err error) {
+	br := bufio.NewReader(a.reader)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			a.size += int64(len(line))
+			return len(line) > 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var entry struct {
+			BookID string `json:"bookId"`
+		}
+		if json.Unmarshal(line, &entry) == nil {
+			a.index[entry.BookID] = append(a.index[entry.BookID], auditSpan{offset: a.size, length: len(line)})
+		} else {
+			logger.Warn("ignoring unreadable audit log entry", "path", a.reader.Name(), "offset", a.size)
+		}
+		a.size += int64(len(line))
+	}
+}
+
+// History returns the entries for bookID in the order they were written,
+// reading them back from the log file; a log without a file has no
+// history to read. Only the index is consulted under the lock, so reading
+// a long history does not hold up Record.
+func (a *AuditLog) History(bookID string) ([]AuditEntry, error) {
+	if a.reader == nil {
+		return nil, ErrHistoryUnavailable
+	}
+	a.mu.Lock()
+	spans := slices.Clone(a.index[bookID])
+	a.mu.Unlock()
+
+	history := make([]AuditEntry, 0, len(spans))
+	for _, span := range spans {
+		line := make([]byte, span.length)
+		if _, err := a.reader.ReadAt(line, span.offset); err != nil {
+			return nil, err
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("reading audit entry at offset %d: %w", span.offset, err)
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+// Record appends an entry for the change of bookID from before to after;
+// before is nil for creates and after is nil for deletes
+func (a *AuditLog) Record(op, bookID string, before, after *Book) error {
+	diff, err := bookDiff(before, after)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	line, err := json.Marshal(AuditEntry{Timestamp: a.clock.Now().UTC(), Op: op, BookID: bookID, Diff: diff})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if a.index == nil {
+		if _, err := a.w.Write(line); err != nil {
+			return err
+		}
+	} else {
+		start := 0
+		if a.torn {
+			// End the line a failed write left, so this entry starts on
+			// its own
+			line = append([]byte{'\n'}, line...)
+			start = 1
+		}
+		n, err := a.w.Write(line)
+		if err != nil {
+			a.discard(line[:n])
+			return err
+		}
+		a.index[bookID] = append(a.index[bookID], auditSpan{offset: a.size + int64(start), length: len(line) - start})
+		a.size += int64(len(line))
+		a.torn = false
+	}
+	if syncer, ok := a.w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// discard undoes the partial write of written, truncating the file back
+// to size. If that fails, the bytes stay in the file: size moves past them
+// and, unless they end a line, the next entry starts with a newline.
+func (a *AuditLog) discard(written []byte) {
+	if len(written) == 0 {
+		return
+	}
+	if truncater, ok := a.w.(interface{ Truncate(int64) error }); ok {
+		if err := truncater.Truncate(a.size); err == nil {
+			return
+		}
+	}
+	a.size += int64(len(written))
+	a.torn = written[len(written)-1] != '\n'
+}
+
+// Close closes the underlying writer if it can be closed
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.reader != nil {
+		a.reader.Close()
+	}
+	if closer, ok := a.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// bookDiff lists the JSON fields that differ between before and after,
+// either of which may be nil. The ID and timestamps are left out; the
+// audit entry carries its own.
+func bookDiff(before, after *Book) (map[string]AuditChange, error) {
+	fields := func(book *Book) (map[string]interface{}, error) {
+		if book == nil {
+			return map[string]interface{}{}, nil
+		}
+		return projectBook(book, nil)
+	}
+	from, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := make(map[string]AuditChange)
+	for _, m := range []map[string]interface{}{from, to} {
+		for name := range m {
+			switch name {
+			case "id", "createdAt", "updatedAt":
+				continue
+			}
+			if !reflect.DeepEqual(from[name], to[name]) {
+				diff[name] = AuditChange{From: from[name], To: to[name]}
+			}
+		}
+	}
+	return diff, nil
+}
@@ -0,0 +1,127 @@
+// Package bookapi implements the RESTful Book Management API from Challenge 9
+package bookapi
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Book represents a book in the database. JSON field names are camelCase
+// (publishedYear, createdAt, ...); the snake_case names used before are no
+// longer recognized.
+type Book struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	PublishedYear int    `json:"publishedYear"`
+	ISBN          string `json:"isbn"`
+	Description   string `json:"description"`
+	Genre         string `json:"genre"`
+
+	// Timestamps are set by the repository; values sent by clients are ignored
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// BookSummary is the reduced form of a Book returned by ?view=summary
+type BookSummary struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	PublishedYear int    `json:"publishedYear"`
+}
+
+// NewBookSummary returns the summary view of a book
+func NewBookSummary(book *Book) BookSummary {
+	return BookSummary{
+		ID:            book.ID,
+		Title:         book.Title,
+		Author:        book.Author,
+		PublishedYear: book.PublishedYear,
+	}
+}
+
+// Media types selecting a version of the Book representation in Accept
+const (
+	mediaTypeBookV1 = "application/vnd.books.v1+json"
+	mediaTypeBookV2 = "application/vnd.books.v2+json"
+)
+
+// BookV1 is the original Book representation, from before genres and
+// timestamps were added
+type BookV1 struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	PublishedYear int    `json:"publishedYear"`
+	ISBN          string `json:"isbn"`
+	Description   string `json:"description"`
+}
+
+// bookMappers turns a book into the representation of each versioned
+// media type; v2 is the current Book
+var bookMappers = map[string]func(*Book) interface{}{
+	mediaTypeBookV1: func(b *Book) interface{} {
+		return BookV1{ID: b.ID, Title: b.Title, Author: b.Author, PublishedYear: b.PublishedYear, ISBN: b.ISBN, Description: b.Description}
+	},
+	mediaTypeBookV2: func(b *Book) interface{} { return b },
+}
+
+// Errors returned by the repository and service layers
+var (
+	ErrBookNotFound = errors.New("book not found")
+	ErrInvalidBook  = errors.New("invalid book")
+	ErrBookExists   = errors.New("book already exists")
+
+	ErrCapacityExceeded   = errors.New("book capacity exceeded")
+	ErrChangesExpired     = errors.New("change token expired")
+	ErrHistoryUnavailable = errors.New("book history requires a file audit log")
+
+	ErrNilRepository = errors.New("book service requires a non-nil repository")
+	ErrNilService    = errors.New("book handler requires a non-nil service")
+)
+
+// BookRepository defines the operations for book data access
+type BookRepository interface {
+	GetAll() ([]*Book, error)
+	GetByID(id string) (*Book, error)
+	Exists(ids []string) map[string]bool
+	Create(book *Book) error
+	CreateWithID(book *Book) error
+	CreateBatch(books []*Book) error
+	CheckCreates() func(book *Book) error
+	Update(id string, book *Book) (BookChange, error)
+	UpdateFunc(id string, update func(book *Book) error) (BookChange, error)
+	Delete(id string) error
+	Merge(keepID, removeID string, merge func(keep, remove *Book)) (kept BookChange, removed *Book, err error)
+	Reassign(id, newID string) (BookChange, error)
+	Increment(id, field string, delta int) (BookChange, error)
+	Touch(id string) (BookChange, error)
+	Pop(id string) (*Book, error)
+	UpdateMany(ids []string, allOrNothing bool, update func(book *Book)) (changes []BookChange, missing []string, err error)
+	UpdateWhere(match func(book *Book) bool, update func(book *Book)) ([]BookChange, error)
+	SearchByAuthor(author string) ([]*Book, error)
+	SearchByTitle(title string) ([]*Book, error)
+	SearchByDescription(term string) ([]*Book, error)
+	SearchByAuthorContext(ctx context.Context, author string) ([]*Book, error)
+	SearchByTitleContext(ctx context.Context, title string) ([]*Book, error)
+	SearchByDescriptionContext(ctx context.Context, term string) ([]*Book, error)
+	SearchByISBNPrefix(prefix string) ([]*Book, error)
+	SearchByYear(year int) ([]*Book, error)
+	SearchByGenre(genre string) ([]*Book, error)
+	SearchByISBNPrefixContext(ctx context.Context, prefix string) ([]*Book, error)
+	FindByISBN(isbn string) ([]*Book, error)
+	AuthorCounts() (map[string]int, error)
+	ISBNs() (map[string][]string, error)
+	ForEach(ctx context.Context, fn func(*Book) error) error
+	Changes(since string, limit int) (*ChangeFeed, error)
+}
+
+// BookChange is a book before and after one write, both taken under the
+// write lock, so no other write can come between them. Writes return it
+// for the audit log.
+type BookChange struct {
+	Before *Book
+	After  *Book
+}
@@ -0,0 +1,8 @@
+// Command bookapi runs the book management API server
+package main
+
+import "bookapi"
+
+func main() {
+	bookapi.Main()
+}
@@ -0,0 +1,464 @@
+package bookapi
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadAPIKeys reads one key per line, skipping blank lines and # comments
+func loadAPIKeys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+// loadConfigFile reads name=value settings, one per line, skipping blank
+// lines and # comments. Names are the command-line flag names, with or
+// without leading dashes. The settings are returned as flag arguments.
+func loadConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name=value", path, n)
+		}
+		if name == "config" {
+			return nil, fmt.Errorf("%s:%d: config files cannot include other config files", path, n)
+		}
+		args = append(args, "-"+name+"="+strings.TrimSpace(value))
+	}
+	return args, scanner.Err()
+}
+
+// Config holds the command-line configuration of the server
+type Config struct {
+	ConfigFile string
+
+	Addr         string
+	APIKeyHeader string
+	APIKeys      []string
+	ReadOnly     bool
+
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+
+	LogLevel  string
+	LogFormat string
+
+	OTLPEndpoint     string
+	TraceSampleRatio float64
+
+	NormalizeAuthors bool
+	UniqueISBNs      bool
+	ISBNPolicy       string
+
+	TLSCert string
+	TLSKey  string
+
+	MissingAsEmpty bool
+	EmptySearch404 bool
+	DefaultSort    string
+	AuthorFormat   string
+
+	CORSOrigins []string
+	CORSMaxAge  time.Duration
+
+	StrictJSON             bool
+	MaxSearchResults       int
+	SearchSummaryThreshold int
+
+	BaseURL string
+
+	MaxBooks             int
+	MaxDescriptionLength int
+
+	DataFile      string
+	FlushInterval time.Duration
+	FlushAfter    int
+
+	SearchTimeout time.Duration
+
+	GzipMinSize int
+	GzipTypes   []string
+
+	ErrorDetail bool
+	ProblemJSON bool
+
+	MaxBatchItems int
+	MaxBodyBytes  int64
+
+	ImportURLTimeout  time.Duration
+	ImportURLMaxBytes int64
+	ImportURLHosts    []string
+
+	SlowRequestThreshold time.Duration
+
+	AuditLog string
+
+	MaxInFlight int
+
+	MaxURLLength   int
+	MaxQueryParams int
+
+	PatchUpsert bool
+
+	MaxSearchTerm    int
+	FuzzyMaxDistance int
+
+	ChangeLogSize int
+
+	DefaultContentType string
+
+	NoTrim       bool
+	DefaultGenre string
+	MaxAuthors   int
+
+	NoListETag bool
+
+	DisabledEndpoints map[string]bool
+	DisabledStatus    int
+}
+
+// parseConfig parses command-line flags into a Config
+func parseConfig(args []string) (*Config, error) {
+	cfg := &Config{}
+	var keys, keysFile, corsOrigins, gzipTypes, disabledEndpoints, importURLHosts string
+
+	fs := flag.NewFlagSet("books", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", "", "file of name=value settings using the flag names; flags on the command line take precedence, and SIGHUP re-reads it")
+	fs.StringVar(&cfg.Addr, "addr", ":8080", "listen address")
+	fs.StringVar(&cfg.APIKeyHeader, "api-key-header", "X-API-Key", "header carrying the API key")
+	fs.StringVar(&keys, "api-keys", "", "comma-separated list of valid API keys (auth is disabled when no keys are set)")
+	fs.StringVar(&keysFile, "api-keys-file", "", "file with one valid API key per line")
+	fs.BoolVar(&cfg.ReadOnly, "read-only", false, "start in read-only mode, rejecting writes with 503")
+	fs.StringVar(&disabledEndpoints, "disable-endpoints", "", "comma-separated endpoint groups to turn off: writes, search, export or admin")
+	fs.IntVar(&cfg.DisabledStatus, "disabled-status", http.StatusNotFound, "status answering requests to disabled endpoints: 404 or 405")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", "text", "log format: text or json")
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector base URL (e.g. http://localhost:4318) receiving request spans; tracing is off when empty")
+	fs.Float64Var(&cfg.TraceSampleRatio, "trace-sample-ratio", 1, "fraction of new traces to sample, from 0 to 1; requests with a traceparent header follow its sampled flag")
+	fs.DurationVar(&cfg.SlowRequestThreshold, "slow-request-threshold", defaultSlowRequestThreshold, "log a warning for requests taking longer than this (0 disables)")
+	fs.BoolVar(&cfg.NormalizeAuthors, "normalize-authors", false, "match authors ignoring punctuation and spacing (e.g. J.R.R. vs JRR)")
+	fs.BoolVar(&cfg.UniqueISBNs, "unique-isbns", false, "deprecated: same as --isbn-policy=unique-only, and conflicts with any other policy")
+	fs.StringVar(&cfg.ISBNPolicy, "isbn-policy", isbnPolicyOptional, "ISBN rule for creates and updates: optional, required (a valid ISBN, else 400) or unique-only (optional, but reusing another book's ISBN fails with 409)")
+	fs.BoolVar(&cfg.PatchUpsert, "patch-upsert", false, "create books on PATCH of an unknown ID instead of answering 404 (clients can override with X-Upsert)")
+	fs.BoolVar(&cfg.MissingAsEmpty, "missing-as-empty", false, "answer GET of an unknown book ID with 200 and {} instead of 404")
+	fs.BoolVar(&cfg.EmptySearch404, "empty-search-404", false, "answer searches without matches with 404 instead of 200 and []")
+	fs.StringVar(&cfg.DefaultSort, "default-sort", "id", "list order without a sort parameter: id, title, author or year, prefixed with - for descending")
+	fs.StringVar(&cfg.AuthorFormat, "author-format", authorFormatAsEntered, "how authors are displayed in every /api/books response and export: as-entered or last-first; storage and search keep the form as entered")
+	fs.StringVar(&corsOrigins, "cors-origins", "", "comma-separated origins allowed to make cross-origin requests (* for any); CORS is off when empty")
+	fs.DurationVar(&cfg.CORSMaxAge, "cors-max-age", 600*time.Second, "how long browsers may cache a CORS preflight response (0 disables caching)")
+	fs.BoolVar(&cfg.NoTrim, "no-trim", false, "store text fields exactly as sent instead of stripping surrounding whitespace")
+	fs.IntVar(&cfg.MaxAuthors, "max-authors", 0, "maximum number of semicolon-separated authors a book may list; more fail with 400 (0 for no cap)")
+	fs.StringVar(&cfg.DefaultGenre, "default-genre", "", "genre given to books created or updated without one; the genre stays optional when empty")
+	fs.BoolVar(&cfg.NoListETag, "no-list-etag", false, "do not tag list responses with an ETag or answer If-None-Match with 304")
+	fs.BoolVar(&cfg.StrictJSON, "strict-json", false, "reject request bodies with unknown fields or trailing data")
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", 0, "maximum number of requests served at once; more fail with 503 (0 for no limit)")
+	fs.IntVar(&cfg.MaxURLLength, "max-url-length", defaultMaxURLLength, "maximum length in bytes of a request's path and query; longer URLs fail with 414 (0 for no cap)")
+	fs.IntVar(&cfg.MaxQueryParams, "max-query-params", defaultMaxQueryParams, "maximum number of query parameter values in a request; more fail with 400 (0 for no cap)")
+	fs.IntVar(&cfg.MaxBatchItems, "max-batch-items", defaultMaxBatchItems, "maximum number of books or IDs in one batch request; larger batches fail with 400 (0 for no cap)")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "maximum size of a JSON request body; larger bodies fail with 413 (0 for no cap)")
+	fs.DurationVar(&cfg.ImportURLTimeout, "import-url-timeout", defaultImportURLTimeout, "maximum time /api/books/import-url may spend fetching a catalog (0 for no limit)")
+	fs.Int64Var(&cfg.ImportURLMaxBytes, "import-url-max-bytes", defaultImportURLMaxBytes, "maximum size of a catalog fetched by /api/books/import-url; larger ones fail with 502 (0 for no cap)")
+	fs.StringVar(&importURLHosts, "import-url-hosts", "", "comma-separated hosts /api/books/import-url may fetch from; any public host when empty")
+	fs.IntVar(&cfg.MaxSearchTerm, "max-search-term", defaultMaxSearchTerm, "maximum length in characters of an author, title or description search term; longer terms fail with 400 (0 for no cap)")
+	fs.IntVar(&cfg.FuzzyMaxDistance, "fuzzy-max-distance", defaultFuzzyMaxDistance, "largest edit distance between a term and a title or author that ?fuzzy=true searches accept")
+	fs.IntVar(&cfg.MaxSearchResults, "max-search-results", defaultMaxSearchResults, "maximum number of search matches returned (0 for no cap)")
+	fs.IntVar(&cfg.SearchSummaryThreshold, "search-summary-threshold", 0, "number of search matches above which they are returned as id/title/author/year summaries with X-Result-Summarized: true (0 to always return full books)")
+	fs.StringVar(&cfg.AuditLog, "audit-log", "", "append a JSON line per create, update and delete to this file; auditing is off when empty")
+	fs.StringVar(&cfg.DataFile, "data-file", "", "persist books to this snapshot file, with a write-ahead log beside it; books are kept in memory only when empty")
+	fs.DurationVar(&cfg.FlushInterval, "flush-interval", 0, "with --data-file, batch writes and flush them to disk this often; writes since the last flush are lost in a crash (0 flushes every write)")
+	fs.IntVar(&cfg.FlushAfter, "flush-after", 0, "with --flush-interval, also flush as soon as this many writes are waiting (0 waits for the interval)")
+	fs.IntVar(&cfg.ChangeLogSize, "change-log-size", defaultChangeLogSize, "number of recent changes kept for GET /api/books/changes; older tokens fail with 410")
+	fs.IntVar(&cfg.MaxBooks, "max-books", 0, "maximum number of stored books; creates beyond it fail with 403 (0 for unlimited)")
+	fs.IntVar(&cfg.MaxDescriptionLength, "max-description-length", 0, "maximum length in characters of a book description, enforced by the repository; longer ones fail with 400 (0 for no cap)")
+	fs.StringVar(&cfg.DefaultContentType, "default-content-type", formatJSON, "response format when the Accept header does not choose one: application/json or application/xml")
+	fs.BoolVar(&cfg.ProblemJSON, "problem-json", false, "always render errors as application/problem+json (RFC 7807); clients can also ask for it with Accept")
+	fs.BoolVar(&cfg.ErrorDetail, "error-detail", false, "return internal error messages to clients (for development); by default they get a generic message and an error ID")
+	fs.IntVar(&cfg.GzipMinSize, "gzip-min-size", defaultGzipMinSize, "smallest response body in bytes that is gzipped")
+	fs.StringVar(&gzipTypes, "gzip-types", defaultGzipTypes, "comma-separated content types eligible for gzip; compression is off when empty")
+	fs.DurationVar(&cfg.SearchTimeout, "search-timeout", defaultSearchTimeout, "maximum time a single search may take before failing with 503 (0 for no limit)")
+	fs.StringVar(&cfg.BaseURL, "base-url", "", "canonical external URL (e.g. https://api.example.com/books-svc) used for generated links; derived from the request when empty")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file; serves HTTPS (and HTTP/2) together with --tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", defaultIdempotencyTTL, "how long Idempotency-Key responses are remembered")
+	fs.IntVar(&cfg.IdempotencyMaxKeys, "idempotency-max-keys", defaultIdempotencyMaxKeys, "maximum number of remembered Idempotency-Key responses")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if cfg.ConfigFile != "" {
+		fileArgs, err := loadConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading config file: %w", err)
+		}
+		// Parse the file first and the command line again, so flags win
+		if err := fs.Parse(append(fileArgs, args...)); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", cfg.ConfigFile, err)
+		}
+	}
+
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			cfg.APIKeys = append(cfg.APIKeys, key)
+		}
+	}
+	for _, origin := range strings.Split(corsOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, origin)
+		}
+	}
+	for _, host := range strings.Split(importURLHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			cfg.ImportURLHosts = append(cfg.ImportURLHosts, host)
+		}
+	}
+	for _, t := range strings.Split(gzipTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.GzipTypes = append(cfg.GzipTypes, t)
+		}
+	}
+	for _, group := range strings.Split(disabledEndpoints, ",") {
+		if group = strings.TrimSpace(group); group == "" {
+			continue
+		}
+		if !slices.Contains(endpointGroups, group) {
+			return nil, fmt.Errorf("--disable-endpoints: unknown group %q, must be one of %s", group, strings.Join(endpointGroups, ", "))
+		}
+		if cfg.DisabledEndpoints == nil {
+			cfg.DisabledEndpoints = make(map[string]bool)
+		}
+		cfg.DisabledEndpoints[group] = true
+	}
+	if cfg.DisabledStatus != http.StatusNotFound && cfg.DisabledStatus != http.StatusMethodNotAllowed {
+		return nil, fmt.Errorf("--disabled-status must be %d or %d, got %d", http.StatusNotFound, http.StatusMethodNotAllowed, cfg.DisabledStatus)
+	}
+	if cfg.DefaultContentType != formatJSON && cfg.DefaultContentType != formatXML {
+		return nil, fmt.Errorf("--default-content-type must be %s or %s, got %q", formatJSON, formatXML, cfg.DefaultContentType)
+	}
+	if cfg.GzipMinSize < 0 {
+		return nil, errors.New("--gzip-min-size must not be negative")
+	}
+	if cfg.MaxSearchResults < 0 {
+		return nil, errors.New("--max-search-results must not be negative")
+	}
+	if cfg.SearchSummaryThreshold < 0 {
+		return nil, errors.New("--search-summary-threshold must not be negative")
+	}
+	if cfg.MaxInFlight < 0 {
+		return nil, errors.New("--max-in-flight must not be negative")
+	}
+	if cfg.MaxURLLength < 0 {
+		return nil, errors.New("--max-url-length must not be negative")
+	}
+	if cfg.MaxQueryParams < 0 {
+		return nil, errors.New("--max-query-params must not be negative")
+	}
+	if cfg.MaxBatchItems < 0 {
+		return nil, errors.New("--max-batch-items must not be negative")
+	}
+	if cfg.MaxBodyBytes < 0 {
+		return nil, errors.New("--max-body-bytes must not be negative")
+	}
+	if cfg.ImportURLTimeout < 0 {
+		return nil, errors.New("--import-url-timeout must not be negative")
+	}
+	if cfg.ImportURLMaxBytes < 0 {
+		return nil, errors.New("--import-url-max-bytes must not be negative")
+	}
+	if cfg.MaxSearchTerm < 0 {
+		return nil, errors.New("--max-search-term must not be negative")
+	}
+	if cfg.FuzzyMaxDistance < 0 {
+		return nil, errors.New("--fuzzy-max-distance must not be negative")
+	}
+	if cfg.SearchTimeout < 0 {
+		return nil, errors.New("--search-timeout must not be negative")
+	}
+	if cfg.MaxBooks < 0 {
+		return nil, errors.New("--max-books must not be negative")
+	}
+	if cfg.MaxAuthors < 0 {
+		return nil, errors.New("--max-authors must not be negative")
+	}
+	if !(cfg.TraceSampleRatio >= 0 && cfg.TraceSampleRatio <= 1) {
+		return nil, errors.New("--trace-sample-ratio must be between 0 and 1")
+	}
+	if cfg.MaxDescriptionLength < 0 {
+		return nil, errors.New("--max-description-length must not be negative")
+	}
+	if cfg.FlushInterval < 0 {
+		return nil, errors.New("--flush-interval must not be negative")
+	}
+	if cfg.FlushAfter < 0 {
+		return nil, errors.New("--flush-after must not be negative")
+	}
+	if cfg.ChangeLogSize <= 0 {
+		return nil, errors.New("--change-log-size must be positive")
+	}
+	if cfg.SlowRequestThreshold < 0 {
+		return nil, errors.New("--slow-request-threshold must not be negative")
+	}
+	if cfg.CORSMaxAge < 0 {
+		return nil, errors.New("--cors-max-age must not be negative")
+	}
+	if cfg.BaseURL != "" {
+		u, err := url.Parse(cfg.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("--base-url %q must be an absolute http or https URL", cfg.BaseURL)
+		}
+	}
+	if keysFile != "" {
+		fileKeys, err := loadAPIKeys(keysFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading API keys: %w", err)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, fileKeys...)
+	}
+	if err := validateSortSpec(cfg.DefaultSort); err != nil {
+		return nil, fmt.Errorf("--default-sort: %w", err)
+	}
+	if cfg.UniqueISBNs {
+		policySet := false
+		fs.Visit(func(f *flag.Flag) { policySet = policySet || f.Name == "isbn-policy" })
+		if policySet && cfg.ISBNPolicy != isbnPolicyUniqueOnly {
+			return nil, fmt.Errorf("--unique-isbns conflicts with --isbn-policy=%s; use --isbn-policy alone", cfg.ISBNPolicy)
+		}
+		cfg.ISBNPolicy = isbnPolicyUniqueOnly
+	}
+	switch cfg.ISBNPolicy {
+	case isbnPolicyOptional, isbnPolicyRequired:
+	case isbnPolicyUniqueOnly:
+		cfg.UniqueISBNs = true
+	default:
+		return nil, fmt.Errorf("--isbn-policy must be %s, %s or %s, got %q", isbnPolicyOptional, isbnPolicyRequired, isbnPolicyUniqueOnly, cfg.ISBNPolicy)
+	}
+	if _, ok := authorFormats[cfg.AuthorFormat]; !ok {
+		return nil, fmt.Errorf("--author-format must be %s or %s, got %q", authorFormatAsEntered, authorFormatLastFirst, cfg.AuthorFormat)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+	return cfg, nil
+}
+
+// ConfigReloader re-reads the configuration and applies the settings that
+// can change while the server runs: read-only mode and the log level.
+// Changes to any other setting are reported and ignored until a restart.
+type ConfigReloader struct {
+	args     []string
+	readOnly *ReadOnlyMode
+	logLevel *slog.LevelVar
+
+	mu      sync.Mutex
+	current *Config
+}
+
+// NewConfigReloader creates a reloader for the server started with args and
+// configured as current
+func NewConfigReloader(args []string, current *Config, readOnly *ReadOnlyMode, logLevel *slog.LevelVar) *ConfigReloader {
+	return &ConfigReloader{args: args, current: current, readOnly: readOnly, logLevel: logLevel}
+}
+
+// Reload parses the configuration again and applies what changed. An
+// invalid configuration is rejected as a whole and nothing is applied.
+func (c *ConfigReloader) Reload() error {
+	next, err := parseConfig(c.args)
+	if err != nil {
+		return err
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(next.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", next.LogLevel)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed []any
+	if next.ReadOnly != c.current.ReadOnly {
+		c.readOnly.Set(next.ReadOnly)
+		changed = append(changed, "read_only", next.ReadOnly)
+	}
+	if next.LogLevel != c.current.LogLevel {
+		c.logLevel.Set(level)
+		changed = append(changed, "log_level", next.LogLevel)
+	}
+	applied := *c.current
+	applied.ReadOnly, applied.LogLevel = next.ReadOnly, next.LogLevel
+
+	// Everything else keeps its startup value, so a later reload reports
+	// it again until the server is restarted
+	var ignored []string
+	was, now := reflect.ValueOf(applied), reflect.ValueOf(*next)
+	for i := 0; i < was.NumField(); i++ {
+		if !reflect.DeepEqual(was.Field(i).Interface(), now.Field(i).Interface()) {
+			ignored = append(ignored, was.Type().Field(i).Name)
+		}
+	}
+	c.current = &applied
+
+	if len(ignored) > 0 {
+		logger.Warn("config settings need a restart and were ignored", "settings", ignored)
+	}
+	if len(changed) > 0 {
+		logger.Info("config reloaded", changed...)
+	} else {
+		logger.Info("config reloaded without changes")
+	}
+	return nil
+}
+
+// Watch reloads the configuration for every signal received on signals
+// until the channel is closed
+func (c *ConfigReloader) Watch(signals <-chan os.Signal) {
+	for range signals {
+		if err := c.Reload(); err != nil {
+			logger.Error("config reload failed; keeping the current settings", "error", err)
+		}
+	}
+}
+
+// serve runs srv on ln, over TLS when a certificate is configured.
+// net/http negotiates HTTP/2 automatically for TLS connections.
+func serve(srv *http.Server, ln net.Listener, cfg *Config) error {
+	if cfg.TLSCert != "" {
+		return srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	}
+	return srv.Serve(ln)
+}
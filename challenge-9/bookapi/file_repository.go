@@ -0,0 +1,658 @@
+package bookapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileBookRepository is an InMemoryBookRepository persisted to a snapshot
+// file. Every write is first appended to a write-ahead log next to the
+// snapshot, so a crash before the next snapshot loses nothing: the log is
+// replayed on startup and then compacted into a fresh snapshot.
+type FileBookRepository struct {
+	*InMemoryBookRepository
+
+	path string
+
+	// wmu serializes writes so the log order matches the order applied
+	wmu        sync.Mutex
+	wal        *os.File
+	walRecords int
+	// compactAfter is the number of logged writes that triggers a snapshot
+	compactAfter int
+	// lastWrite is when a write was last durably logged or snapshotted
+	lastWrite atomic.Pointer[time.Time]
+
+	// With batched flushing, log records wait in pending until the next
+	// flush; see SetFlushInterval
+	flushInterval  time.Duration
+	flushAfter     int
+	pending        bytes.Buffer
+	pendingRecords int
+	stopFlushing   chan struct{}
+	flushing       sync.WaitGroup
+}
+
+// walRecord is one line of the write-ahead log. NextID is the ID counter
+// after the write, so replay restores it even for deletes.
+type walRecord struct {
+	Op     string `json:"op"`
+	ID     string `json:"id,omitempty"`
+	Book   *Book  `json:"book,omitempty"`
+	NextID int    `json:"nextId"`
+}
+
+// Write-ahead log operations
+const (
+	walPut    = "put"
+	walDelete = "delete"
+)
+
+// defaultCompactAfter bounds the log length, and so the replay time
+const defaultCompactAfter = 1000
+
+// NewFileBookRepository opens the snapshot at path, replays the write-ahead
+// log at path+".wal" on top of it and compacts both into a new snapshot.
+// Missing files start an empty catalog, and a missing directory is created.
+func NewFileBookRepository(path string, opts ...RepositoryOption) (*FileBookRepository, error) {
+	if err := checkWritableDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	f := &FileBookRepository{
+		InMemoryBookRepository: NewInMemoryBookRepository(opts...),
+		path:                   path,
+		compactAfter:           defaultCompactAfter,
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := f.InMemoryBookRepository.Restore(data); err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+
+	f.wal, err = os.OpenFile(f.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		f.wal.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// checkWritableDir creates dir if needed and verifies that files can be
+// created in it, so a misconfigured data file fails at startup with a
+// message naming the directory
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("data directory %s cannot be created: %w", dir, err)
+	}
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// walPath is the location of the write-ahead log
+func (f *FileBookRepository) walPath() string {
+	return f.path + ".wal"
+}
+
+// replay applies the write-ahead log to the in-memory store. A torn final
+// line, left by a crash in the middle of an append, is ignored.
+func (f *FileBookRepository) replay() error {
+	data, err := os.ReadFile(f.walPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := f.InMemoryBookRepository
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			if i == len(lines)-1 {
+				logger.Warn("ignoring torn write-ahead log record", "path", f.walPath())
+				break
+			}
+			return fmt.Errorf("replaying %s: record %d: %w", f.walPath(), i+1, err)
+		}
+		switch rec.Op {
+		case walPut:
+			if rec.Book == nil || rec.Book.ID == "" {
+				return fmt.Errorf("replaying %s: record %d: put without a book", f.walPath(), i+1)
+			}
+			r.put(rec.Book)
+		case walDelete:
+			r.remove(rec.ID)
+		default:
+			return fmt.Errorf("replaying %s: record %d: unknown op %q", f.walPath(), i+1, rec.Op)
+		}
+		if rec.NextID > r.nextID {
+			r.nextID = rec.NextID
+		}
+	}
+	return nil
+}
+
+// logged runs write, which changes the in-memory store and returns the
+// records describing the change, and logs them. Should logging fail, the
+// in-memory change is undone, so no change is kept that a restart would
+// lose. f.wmu must be held.
+func (f *FileBookRepository) logged(write func() ([]walRecord, error)) error {
+	r := f.InMemoryBookRepository
+	r.mu.Lock()
+	r.journal = &undoJournal{nextID: r.nextID}
+	r.mu.Unlock()
+	recs, err := write()
+	r.mu.Lock()
+	journal := r.journal
+	r.journal = nil
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := f.log(recs...); err != nil {
+		r.undo(journal)
+		return err
+	}
+	return nil
+}
+
+// undo reverts the writes recorded in journal, newest first. The change
+// feed reports the reverts as changes of their own.
+func (r *InMemoryBookRepository) undo(journal *undoJournal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(journal.entries) - 1; i >= 0; i-- {
+		if entry := journal.entries[i]; entry.old != nil {
+			r.put(entry.old)
+		} else {
+			r.remove(entry.id)
+		}
+	}
+	r.nextID = journal.nextID
+}
+
+// log appends records to the write-ahead log, flushing them at once unless
+// batched flushing is on and fewer than flushAfter records are waiting.
+// The records are encoded before anything is queued, and a failed flush
+// drops them again, so a failed write leaves nothing behind to be flushed
+// later. f.wmu must be held.
+func (f *FileBookRepository) log(recs ...walRecord) error {
+	nextID := f.Info().NextID
+	var encoded bytes.Buffer
+	enc := json.NewEncoder(&encoded)
+	for _, rec := range recs {
+		rec.NextID = nextID
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	mark := f.pending.Len()
+	f.pending.Write(encoded.Bytes())
+	f.pendingRecords += len(recs)
+	if f.flushInterval > 0 && (f.flushAfter == 0 || f.pendingRecords < f.flushAfter) {
+		return nil
+	}
+	if err := f.flush(); err != nil {
+		f.pending.Truncate(mark)
+		f.pendingRecords -= len(recs)
+		return err
+	}
+	return nil
+}
+
+// flush writes the pending records to the write-ahead log and syncs it,
+// compacting once the log is long enough. A failed write or sync is cut
+// off the log again. Once the records are synced the writes are durable,
+// so a failed compaction is only logged. f.wmu must be held.
+func (f *FileBookRepository) flush() error {
+	if f.pendingRecords == 0 {
+		return nil
+	}
+	size, err := f.wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", f.walPath(), err)
+	}
+	if _, err := f.wal.Write(f.pending.Bytes()); err != nil {
+		f.wal.Truncate(size)
+		return fmt.Errorf("writing %s: %w", f.walPath(), err)
+	}
+	if err := f.wal.Sync(); err != nil {
+		f.wal.Truncate(size)
+		return fmt.Errorf("syncing %s: %w", f.walPath(), err)
+	}
+	f.walRecords += f.pendingRecords
+	f.pending.Reset()
+	f.pendingRecords = 0
+	f.markWritten()
+	if f.walRecords >= f.compactAfter {
+		if err := f.compact(); err != nil {
+			logger.Error("failed to compact write-ahead log", "path", f.walPath(), "error", err)
+		}
+	}
+	return nil
+}
+
+// SetFlushInterval batches log writes: records are flushed every interval,
+// or as soon as flushAfter of them are waiting when flushAfter is positive.
+// Writes made since the last flush are lost in a crash, but not on Close,
+// which flushes. The default, and an interval of 0, flushes every write.
+func (f *FileBookRepository) SetFlushInterval(interval time.Duration, flushAfter int) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	if f.stopFlushing != nil {
+		close(f.stopFlushing)
+		f.stopFlushing = nil
+	}
+	f.flushInterval, f.flushAfter = interval, flushAfter
+	if interval <= 0 {
+		if err := f.flush(); err != nil {
+			logger.Error("failed to flush write-ahead log", "path", f.walPath(), "error", err)
+		}
+		return
+	}
+	stop := make(chan struct{})
+	f.stopFlushing = stop
+	f.flushing.Add(1)
+	go func() {
+		defer f.flushing.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.wmu.Lock()
+				err := f.flush()
+				f.wmu.Unlock()
+				if err != nil {
+					logger.Error("failed to flush write-ahead log", "path", f.walPath(), "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// compact writes the whole store to the snapshot file and empties the log.
+// The snapshot is replaced atomically; should the log survive a crash right
+// after, replaying it again is harmless. f.wmu must be held or f unshared.
+func (f *FileBookRepository) compact() error {
+	data, err := f.Snapshot()
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	// Sync the directory too, or the rename itself may not survive a crash
+	if err := syncDir(filepath.Dir(f.path)); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := f.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncating %s: %w", f.walPath(), err)
+	}
+	// The snapshot includes any writes still waiting to be flushed
+	f.pending.Reset()
+	f.pendingRecords = 0
+	f.walRecords = 0
+	f.markWritten()
+	return nil
+}
+
+// markWritten records that changes reached the disk
+func (f *FileBookRepository) markWritten() {
+	now := f.clock.Now()
+	f.lastWrite.Store(&now)
+}
+
+// writeFileSync writes data to name and syncs it to disk
+func writeFileSync(name string, data []byte) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir syncs a directory, making renames and creations in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// Close stops batched flushing, compacts the log and any pending writes
+// into the snapshot and releases the log file
+func (f *FileBookRepository) Close() error {
+	f.wmu.Lock()
+	if f.stopFlushing != nil {
+		close(f.stopFlushing)
+		f.stopFlushing = nil
+	}
+	f.wmu.Unlock()
+	f.flushing.Wait()
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	err := f.compact()
+	if cerr := f.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Info reports the file backend and its snapshot location
+func (f *FileBookRepository) Info() RepositoryInfo {
+	info := f.InMemoryBookRepository.Info()
+	info.Backend = "file"
+	info.Location = f.path
+	info.LastWrite = f.lastWrite.Load()
+	return info
+}
+
+// Create stores a new book and logs it
+func (f *FileBookRepository) Create(book *Book) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	return f.logged(func() ([]walRecord, error) {
+		if err := f.InMemoryBookRepository.Create(book); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: book}}, nil
+	})
+}
+
+// CreateWithID stores a book under its own ID and logs it
+func (f *FileBookRepository) CreateWithID(book *Book) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	return f.logged(func() ([]walRecord, error) {
+		if err := f.InMemoryBookRepository.CreateWithID(book); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: book}}, nil
+	})
+}
+
+// CreateBatch stores several books and logs them
+func (f *FileBookRepository) CreateBatch(books []*Book) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	return f.logged(func() ([]walRecord, error) {
+		if err := f.InMemoryBookRepository.CreateBatch(books); err != nil {
+			return nil, err
+		}
+		recs := make([]walRecord, len(books))
+		for i, book := range books {
+			recs[i] = walRecord{Op: walPut, Book: book}
+		}
+		return recs, nil
+	})
+}
+
+// UpdateFunc updates a book in place and logs the result
+func (f *FileBookRepository) UpdateFunc(id string, update func(book *Book) error) (BookChange, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var change BookChange
+	err := f.logged(func() (recs []walRecord, err error) {
+		if change, err = f.InMemoryBookRepository.UpdateFunc(id, update); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: change.After}}, nil
+	})
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, nil
+}
+
+// Update replaces a book and logs it
+func (f *FileBookRepository) Update(id string, book *Book) (BookChange, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var change BookChange
+	err := f.logged(func() (recs []walRecord, err error) {
+		if change, err = f.InMemoryBookRepository.Update(id, book); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: change.After}}, nil
+	})
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, nil
+}
+
+// Delete removes a book and logs it
+func (f *FileBookRepository) Delete(id string) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	return f.logged(func() ([]walRecord, error) {
+		if err := f.InMemoryBookRepository.Delete(id); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walDelete, ID: id}}, nil
+	})
+}
+
+// Merge merges two books and logs the result
+func (f *FileBookRepository) Merge(keepID, removeID string, merge func(keep, remove *Book)) (BookChange, *Book, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var (
+		kept    BookChange
+		removed *Book
+	)
+	err := f.logged(func() (recs []walRecord, err error) {
+		if kept, removed, err = f.InMemoryBookRepository.Merge(keepID, removeID, merge); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: kept.After}, {Op: walDelete, ID: removeID}}, nil
+	})
+	if err != nil {
+		return BookChange{}, nil, err
+	}
+	return kept, removed, nil
+}
+
+// Reassign moves a book to a new ID and logs the move
+func (f *FileBookRepository) Reassign(id, newID string) (BookChange, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var change BookChange
+	err := f.logged(func() (recs []walRecord, err error) {
+		if change, err = f.InMemoryBookRepository.Reassign(id, newID); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walDelete, ID: id}, {Op: walPut, Book: change.After}}, nil
+	})
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, nil
+}
+
+// Increment adjusts a numeric field and logs the changed book
+func (f *FileBookRepository) Increment(id, field string, delta int) (BookChange, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var change BookChange
+	err := f.logged(func() (recs []walRecord, err error) {
+		if change, err = f.InMemoryBookRepository.Increment(id, field, delta); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: change.After}}, nil
+	})
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, nil
+}
+
+// Touch bumps UpdatedAt and logs the touched book
+func (f *FileBookRepository) Touch(id string) (BookChange, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var change BookChange
+	err := f.logged(func() (recs []walRecord, err error) {
+		if change, err = f.InMemoryBookRepository.Touch(id); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walPut, Book: change.After}}, nil
+	})
+	if err != nil {
+		return BookChange{}, err
+	}
+	return change, nil
+}
+
+// Pop removes and returns a book and logs the deletion
+func (f *FileBookRepository) Pop(id string) (*Book, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var book *Book
+	err := f.logged(func() (recs []walRecord, err error) {
+		if book, err = f.InMemoryBookRepository.Pop(id); err != nil {
+			return nil, err
+		}
+		return []walRecord{{Op: walDelete, ID: id}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// UpdateMany updates several books and logs the ones that changed
+func (f *FileBookRepository) UpdateMany(ids []string, allOrNothing bool, update func(book *Book)) ([]BookChange, []string, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var (
+		changes []BookChange
+		missing []string
+	)
+	err := f.logged(func() (recs []walRecord, err error) {
+		if changes, missing, err = f.InMemoryBookRepository.UpdateMany(ids, allOrNothing, update); err != nil {
+			return nil, err
+		}
+		return changeRecords(changes), nil
+	})
+	if err != nil {
+		return nil, missing, err
+	}
+	return changes, missing, nil
+}
+
+// UpdateWhere updates the matching books and logs them
+func (f *FileBookRepository) UpdateWhere(match func(book *Book) bool, update func(book *Book)) ([]BookChange, error) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	var changes []BookChange
+	err := f.logged(func() (recs []walRecord, err error) {
+		if changes, err = f.InMemoryBookRepository.UpdateWhere(match, update); err != nil {
+			return nil, err
+		}
+		return changeRecords(changes), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// changeRecords returns a put record for the result of each change
+func changeRecords(changes []BookChange) []walRecord {
+	recs := make([]walRecord, len(changes))
+	for i, change := range changes {
+		recs[i] = walRecord{Op: walPut, Book: change.After}
+	}
+	return recs
+}
+
+// Restore replaces the store with a snapshot and persists it immediately.
+// Should writing the snapshot fail, the previous books are put back.
+func (f *FileBookRepository) Restore(data []byte) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	previous, err := f.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := f.InMemoryBookRepository.Restore(data); err != nil {
+		return err
+	}
+	if err := f.compact(); err != nil {
+		if rerr := f.InMemoryBookRepository.Restore(previous); rerr != nil {
+			logger.Error("failed to roll back restore", "path", f.path, "error", rerr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,2042 @@
+package bookapi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BookHandler handles HTTP requests for book operations
+type BookHandler struct {
+	Service     BookService
+	Idempotency *IdempotencyStore
+
+	// MissingAsEmpty makes GET of an unknown ID return 200 with {} instead of 404
+	MissingAsEmpty bool
+	// EmptySearch404 makes searches without matches return 404 instead of []
+	EmptySearch404 bool
+	// DefaultSort is the list order used when the request has no sort parameter
+	DefaultSort string
+	// AuthorFormat is the authorFormats mode used to display authors in
+	// every /api/books response: the "author" fields of JSON bodies, which
+	// covers books, author groups and author counts, and the CSV and ZIP
+	// exports. Request bodies and search terms are not affected; empty
+	// shows authors as entered.
+	AuthorFormat string
+	// StrictJSON rejects request bodies with unknown fields or trailing data
+	StrictJSON bool
+	// MaxSearchResults caps the number of search matches returned; 0 means no cap
+	MaxSearchResults int
+	// SearchSummaryThreshold is the number of search matches above which
+	// they are returned as BookSummary values; 0 always returns full books
+	SearchSummaryThreshold int
+	// BaseURL is the canonical external URL used for generated links; when
+	// empty, links are derived from the request
+	BaseURL string
+	// SearchTimeout bounds how long a search may scan; 0 means no limit
+	SearchTimeout time.Duration
+	// ErrorDetail returns internal error messages to clients; otherwise they
+	// get a generic message and an ID to find the logged error by
+	ErrorDetail bool
+	// MaxBatchItems caps the number of books or IDs in one batch request;
+	// 0 means no cap
+	MaxBatchItems int
+	// MaxBodyBytes caps the size of decoded JSON request bodies; 0 means no
+	// cap. The streaming import is not affected.
+	MaxBodyBytes int64
+	// PatchUpsert makes PATCH of an unknown ID create the book; the X-Upsert
+	// header overrides it per request
+	PatchUpsert bool
+	// MaxSearchTerm caps the length in runes of author, title and
+	// description search terms; 0 means no cap
+	MaxSearchTerm int
+	// FuzzyMaxDistance is the largest edit distance ?fuzzy=true accepts
+	FuzzyMaxDistance int
+	// FuzzyMaxCandidates caps how many books one fuzzy search evaluates;
+	// 0 means all
+	FuzzyMaxCandidates int
+	// ImportURLTimeout bounds fetching a catalog for /api/books/import-url;
+	// 0 means no limit
+	ImportURLTimeout time.Duration
+	// ImportURLMaxBytes caps the size of a catalog fetched for
+	// /api/books/import-url; 0 means no cap
+	ImportURLMaxBytes int64
+	// ImportURLClient fetches catalogs for /api/books/import-url. The
+	// default only connects to public addresses and follows no redirects.
+	ImportURLClient *http.Client
+	// ImportURLHosts, when set, lists the only hosts catalogs may be
+	// fetched from
+	ImportURLHosts []string
+	// ListETags tags list responses with a weak ETag and answers a matching
+	// If-None-Match with 304; it is on by default
+	ListETags bool
+	// DisabledEndpoints holds the endpoint groups the router turns away
+	// with DisabledStatus (404 or 405)
+	DisabledEndpoints map[string]bool
+	DisabledStatus    int
+}
+
+// NewBookHandler creates a new book handler. It panics if service is nil;
+// use NewCheckedBookHandler to get ErrNilService instead.
+func NewBookHandler(service BookService) *BookHandler {
+	h, err := NewCheckedBookHandler(service)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// NewCheckedBookHandler creates a new book handler, returning ErrNilService
+// if service is nil
+func NewCheckedBookHandler(service BookService) (*BookHandler, error) {
+	if isNil(service) {
+		return nil, ErrNilService
+	}
+	return &BookHandler{
+		Service:            service,
+		Idempotency:        NewIdempotencyStore(defaultIdempotencyTTL, defaultIdempotencyMaxKeys),
+		MaxSearchResults:   defaultMaxSearchResults,
+		SearchTimeout:      defaultSearchTimeout,
+		MaxBatchItems:      defaultMaxBatchItems,
+		MaxBodyBytes:       defaultMaxBodyBytes,
+		MaxSearchTerm:      defaultMaxSearchTerm,
+		FuzzyMaxDistance:   defaultFuzzyMaxDistance,
+		FuzzyMaxCandidates: defaultFuzzyMaxCandidates,
+		ImportURLTimeout:   defaultImportURLTimeout,
+		ImportURLMaxBytes:  defaultImportURLMaxBytes,
+		ImportURLClient:    newImportURLClient(),
+		ListETags:          true,
+		DisabledStatus:     http.StatusNotFound,
+	}, nil
+}
+
+// HandleBooks processes the book-related endpoints
+func (h *BookHandler) HandleBooks(w http.ResponseWriter, r *http.Request) {
+	if format := authorFormats[h.AuthorFormat]; format != nil {
+		w = &authorDisplayWriter{ResponseWriter: w, format: format}
+	}
+	// A trailing slash names the same resource, so /api/books/ is the collection
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/books"), "/")
+
+	if path == "" {
+		h.handleCollection(w, r)
+		return
+	}
+	segment, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if route, ok := collectionRoutes[segment]; ok && rest == "" {
+		route(h, w, r)
+		return
+	}
+	if route, ok := prefixRoutes[segment]; ok && rest != "" {
+		route(h, w, r, rest)
+		return
+	}
+	if rest != "" {
+		h.handleItemAction(w, r, segment, rest)
+		return
+	}
+	h.handleItem(w, r, segment)
+}
+
+// collectionRoutes are the endpoints under /api/books/{name}. Their names
+// cannot be used as book IDs, which the routes would shadow.
+var collectionRoutes = map[string]func(*BookHandler, http.ResponseWriter, *http.Request){
+	"search":          (*BookHandler).handleSearch,
+	"validate":        (*BookHandler).handleValidate,
+	"extremes":        (*BookHandler).handleExtremes,
+	"batch":           (*BookHandler).handleBatch,
+	"import":          (*BookHandler).handleImport,
+	"import-url":      (*BookHandler).handleImportURL,
+	"merge":           (*BookHandler).handleMerge,
+	"categorize":      (*BookHandler).handleCategorize,
+	"genre-by-author": (*BookHandler).handleGenreByAuthor,
+	"lookup":          (*BookHandler).handleLookup,
+	"duplicates":      (*BookHandler).handleDuplicates,
+	"incomplete":      (*BookHandler).handleIncomplete,
+	"quality":         (*BookHandler).handleQuality,
+	"by-author":       (*BookHandler).handleByAuthor,
+	"authors":         (*BookHandler).handleAuthors,
+	"popular":         (*BookHandler).handlePopular,
+	"changes":         (*BookHandler).handleChanges,
+	"isbns":           (*BookHandler).handleISBNs,
+	"export":          (*BookHandler).handleExport,
+	"recent":          (*BookHandler).handleRecent,
+	"by-decade":       (*BookHandler).handleByDecade,
+	"index":           (*BookHandler).handleIndex,
+}
+
+// prefixRoutes are the endpoints under /api/books/{name}/{value}, called
+// with the value
+var prefixRoutes = map[string]func(*BookHandler, http.ResponseWriter, *http.Request, string){
+	"resolve":       (*BookHandler).handleResolve,
+	"validate-isbn": (*BookHandler).handleValidateISBN,
+}
+
+// isRouteName reports whether id names a route under /api/books, so a book
+// stored under it could not be reached
+func isRouteName(id string) bool {
+	_, collection := collectionRoutes[id]
+	_, prefix := prefixRoutes[id]
+	return collection || prefix
+}
+
+// healthStatus is the response body of /healthz
+type healthStatus struct {
+	Status    string     `json:"status"`
+	Backend   string     `json:"backend,omitempty"`
+	Location  string     `json:"location,omitempty"`
+	LastWrite *time.Time `json:"lastWrite,omitempty"`
+}
+
+// HandleHealth reports that the server is up and, when the repository can
+// describe itself, which backend it uses, where it stores data (with
+// credentials redacted) and when it last wrote
+func (h *BookHandler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok"}
+	if provider, ok := h.Service.(interface{ RepositoryInfo() (RepositoryInfo, bool) }); ok {
+		if info, ok := provider.RepositoryInfo(); ok {
+			status.Backend = info.Backend
+			status.Location = redactDSN(info.Location)
+			status.LastWrite = info.LastWrite
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X bookapi.version=1.2.0 -X bookapi.commit=$(git rev-parse HEAD) -X bookapi.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/bookapi
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// VersionInfo describes the running build
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// HandleVersion serves GET /api/version
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	})
+}
+
+// errEmptyBody is returned by decodeJSON for a body without any JSON value
+var errEmptyBody = errors.New("request body is empty")
+
+// decodeJSON decodes the request body into v. In strict mode unknown fields
+// and anything after the first JSON value, such as a second object, are errors.
+func (h *BookHandler) decodeJSON(r *http.Request, v interface{}) error {
+	body := r.Body
+	if h.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(nil, body, h.MaxBodyBytes)
+	}
+	dec := json.NewDecoder(body)
+	if h.StrictJSON {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			// Nothing but whitespace; not worth a field-by-field validation error
+			return errEmptyBody
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" && strings.HasPrefix(typeErr.Value, "number") {
+			// Overflowing or fractional numbers, e.g. a year of 1e400 or 1999.5
+			return fmt.Errorf("invalid JSON body: field %s must be a whole number within range, got %s",
+				typeErr.Field, strings.TrimPrefix(typeErr.Value, "number "))
+		}
+		var sizeErr *http.MaxBytesError
+		if errors.As(err, &sizeErr) {
+			return fmt.Errorf("request body exceeds %d bytes: %w", sizeErr.Limit, err)
+		}
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	if h.StrictJSON {
+		if _, err := dec.Token(); err != io.EOF {
+			return errors.New("invalid JSON body: unexpected data after the JSON value")
+		}
+	}
+	return nil
+}
+
+// writeDecodeError reports a decodeJSON failure: 413 when the body was too
+// large, 400 otherwise
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var sizeErr *http.MaxBytesError
+	if errors.As(err, &sizeErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+// checkBatchSize rejects batches with more than MaxBatchItems entries before
+// any of them is processed
+func (h *BookHandler) checkBatchSize(w http.ResponseWriter, n int) bool {
+	if h.MaxBatchItems > 0 && n > h.MaxBatchItems {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("batch has %d items, at most %d are allowed", n, h.MaxBatchItems))
+		return false
+	}
+	return true
+}
+
+// handleCollection serves /api/books
+func (h *BookHandler) handleCollection(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listBooks(w, r)
+	case http.MethodPost:
+		h.createBook(w, r)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// negotiateBookVersion picks the book representation from the versioned
+// media types in Accept. Without one the current Book is used and
+// mediaType is empty; an unknown version is answered with 406.
+func negotiateBookVersion(w http.ResponseWriter, r *http.Request) (mediaType string, ok bool) {
+	addVary(w.Header(), "Accept")
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || !strings.HasPrefix(mt, "application/vnd.books.") {
+			continue
+		}
+		if _, known := bookMappers[mt]; !known {
+			writeError(w, http.StatusNotAcceptable, fmt.Sprintf("unknown book representation %q; use %s or %s", mt, mediaTypeBookV1, mediaTypeBookV2))
+			return "", false
+		}
+		return mt, true
+	}
+	return "", true
+}
+
+// writeBook writes book in the representation of mediaType, or as the
+// current Book when mediaType is empty
+func writeBook(w http.ResponseWriter, status int, mediaType string, book *Book) {
+	mapper, ok := bookMappers[mediaType]
+	if !ok {
+		writeJSON(w, status, book)
+		return
+	}
+	writeVersioned(w, status, mediaType, mapper(book))
+}
+
+// writeBookList is writeBook for a list of books
+func writeBookList(w http.ResponseWriter, status int, mediaType string, books []*Book) {
+	mapper, ok := bookMappers[mediaType]
+	if !ok {
+		writeJSON(w, status, books)
+		return
+	}
+	mapped := make([]interface{}, len(books))
+	for i, book := range books {
+		mapped[i] = mapper(book)
+	}
+	writeVersioned(w, status, mediaType, mapped)
+}
+
+// writeVersioned is writeJSON with a versioned media type as Content-Type
+func writeVersioned(w http.ResponseWriter, status int, mediaType string, v interface{}) {
+	addVary(w.Header(), "Accept")
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	encodeJSON(w, v)
+}
+
+// listBooks serves GET /api/books
+func (h *BookHandler) listBooks(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateBookVersion(w, r)
+	if !ok {
+		return
+	}
+	view := r.URL.Query().Get("view")
+	if view != "" && view != "full" && view != "summary" {
+		writeError(w, http.StatusBadRequest, "view must be full or summary")
+		return
+	}
+	sortSpec := r.URL.Query().Get("sort")
+	if sortSpec == "" {
+		sortSpec = h.DefaultSort
+	}
+	if err := validateSortSpec(sortSpec); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	idFrom, idTo, hasRange, err := parseIDRange(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if h.notModified(w, r) {
+		return
+	}
+
+	var books []*Book
+	yearParam := r.URL.Query().Get("year")
+	switch {
+	case yearParam != "":
+		year, convErr := strconv.Atoi(yearParam)
+		if convErr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("year must be an integer, got %q", yearParam))
+			return
+		}
+		books, err = h.Service.SearchBooksByYear(year)
+		if err == nil && hasRange {
+			if err = checkIDRange(idFrom, idTo); err == nil {
+				books = filterBooks(books, func(b *Book) bool { return inIDRange(b.ID, idFrom, idTo) })
+			}
+		}
+	case hasRange:
+		books, err = h.Service.GetBooksByIDRange(idFrom, idTo)
+	default:
+		books, err = h.Service.GetAllBooks()
+	}
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	sortBooks(books, sortSpec)
+	if view == "summary" {
+		summaries := make([]BookSummary, len(books))
+		for i, book := range books {
+			summaries[i] = NewBookSummary(book)
+		}
+		writeJSON(w, http.StatusOK, summaries)
+		return
+	}
+	writeBookList(w, http.StatusOK, mediaType, books)
+}
+
+// notModified sets the list ETag and, when If-None-Match carries it,
+// answers 304 and reports true. The ETag combines the service's list
+// version, which changes on every write, with a hash of the query and
+// Accept header, which select the representation. It is read before the
+// books, so a write racing the request can only make the tag stale.
+func (h *BookHandler) notModified(w http.ResponseWriter, r *http.Request) bool {
+	if !h.ListETags {
+		return false
+	}
+	versioner, ok := h.Service.(interface{ ListVersion() (string, bool) })
+	if !ok {
+		return false
+	}
+	version, ok := versioner.ListVersion()
+	if !ok {
+		return false
+	}
+	variant := fnv.New32a()
+	io.WriteString(variant, r.URL.RawQuery)
+	variant.Write([]byte{0})
+	io.WriteString(variant, r.Header.Get("Accept"))
+	etag := fmt.Sprintf(`W/"%s-%08x"`, version, variant.Sum32())
+
+	// The tag depends on Accept, so caches must key the 304 on it too
+	addVary(w.Header(), "Accept")
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header lists etag or is *,
+// comparing weakly as RFC 9110 requires for If-None-Match
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIDRange reads the idFrom and idTo parameters, which must be given
+// together as integers
+func parseIDRange(query url.Values) (from, to int, ok bool, err error) {
+	fromParam, toParam := query.Get("idFrom"), query.Get("idTo")
+	if fromParam == "" && toParam == "" {
+		return 0, 0, false, nil
+	}
+	if fromParam == "" || toParam == "" {
+		return 0, 0, false, errors.New("idFrom and idTo must be given together")
+	}
+	if from, err = strconv.Atoi(fromParam); err != nil {
+		return 0, 0, false, fmt.Errorf("idFrom must be an integer, got %q", fromParam)
+	}
+	if to, err = strconv.Atoi(toParam); err != nil {
+		return 0, 0, false, fmt.Errorf("idTo must be an integer, got %q", toParam)
+	}
+	return from, to, true, nil
+}
+
+// createBook serves POST /api/books, replaying the stored response when an
+// Idempotency-Key header repeats a previous request
+func (h *BookHandler) createBook(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || h.Idempotency == nil {
+		h.doCreateBook(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	resp, err := h.Idempotency.Do(key, body, func() *responseBuffer {
+		buf := newResponseBuffer()
+		// Authors are put in display form as the body is encoded, so the
+		// buffer needs the format w would have applied
+		var bw http.ResponseWriter = buf
+		if dw, ok := w.(*authorDisplayWriter); ok {
+			bw = &authorDisplayWriter{ResponseWriter: buf, format: dw.format}
+		}
+		h.doCreateBook(bw, r)
+		return buf
+	})
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	resp.writeTo(w)
+}
+
+// doCreateBook decodes and stores a new book
+func (h *BookHandler) doCreateBook(w http.ResponseWriter, r *http.Request) {
+	var book Book
+	if err := h.decodeJSON(r, &book); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := h.Service.CreateBookContext(r.Context(), &book); err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	w.Header().Set("Location", h.absoluteURL(r, "/api/books/"+url.PathEscape(book.ID)))
+	writeJSON(w, http.StatusCreated, book)
+}
+
+// absoluteURL turns a server path into an absolute URL, preferring BaseURL
+// over the scheme and host the request arrived with
+func (h *BookHandler) absoluteURL(r *http.Request, path string) string {
+	if h.BaseURL != "" {
+		return strings.TrimSuffix(h.BaseURL, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// validationResult is the response body of /api/books/validate
+type validationResult struct {
+	Valid  bool         `json:"valid"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// handleValidate serves POST /api/books/validate, checking a book without storing it
+func (h *BookHandler) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var book Book
+	if err := h.decodeJSON(r, &book); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	err := h.Service.ValidateBook(&book)
+	var verr *ValidationError
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, validationResult{Valid: true})
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusUnprocessableEntity, validationResult{Errors: verr.Fields})
+	default:
+		h.writeServiceError(w, err)
+	}
+}
+
+// handleBatch serves /api/books/batch: POST creates every book in a JSON
+// array and DELETE removes the books listed in {"ids": [...]}
+func (h *BookHandler) handleBatch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.createBatch(w, r)
+	case http.MethodDelete:
+		h.deleteBatch(w, r)
+	default:
+		writeMethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// createBatch serves POST /api/books/batch
+func (h *BookHandler) createBatch(w http.ResponseWriter, r *http.Request) {
+	var books []*Book
+	if err := h.decodeJSON(r, &books); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if !h.checkBatchSize(w, len(books)) {
+		return
+	}
+	summary, err := h.Service.CreateBooks(books)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// deleteBatch serves DELETE /api/books/batch
+func (h *BookHandler) deleteBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if !h.checkBatchSize(w, len(req.IDs)) {
+		return
+	}
+	summary, err := h.Service.DeleteBooks(req.IDs)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// handleImport serves POST /api/books/import. The body is a JSON array, or
+// CSV with a header row when sent as text/csv, that is decoded and stored
+// one element at a time, so memory use does not grow with the size of the
+// import. CSV takes an optional delimiter query parameter. With dryRun=true
+// each book is checked as a create would be, against the stored books and
+// the books before it, and nothing is stored; dry runs are not writes, so
+// read-only mode and disabled writes still allow them.
+func (h *BookHandler) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	dryRun := false
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "dryRun must be true or false")
+			return
+		}
+	}
+	create := h.Service.CreateBook
+	if dryRun {
+		create = h.Service.DryRunCreates()
+	}
+
+	var (
+		summary *BatchSummary
+		err     error
+	)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		comma, derr := parseDelimiter(r.URL.Query().Get("delimiter"))
+		if derr != nil {
+			writeError(w, http.StatusBadRequest, derr.Error())
+			return
+		}
+		summary, err = tracedImport(r.Context(), "BookHandler.ImportCSV", func() (*BatchSummary, error) {
+			return importCSVStream(r.Body, comma, create)
+		})
+	} else {
+		summary, err = tracedImport(r.Context(), "BookHandler.ImportJSON", func() (*BatchSummary, error) {
+			return importJSONStream(r.Body, create)
+		})
+	}
+	summary.DryRun = dryRun
+	if err != nil {
+		// Elements before the malformed one stay imported; report them too
+		writeJSON(w, http.StatusBadRequest, summary)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// tracedImport runs an import in a span named name, recording how many
+// books it created and how many failed. Books are not traced one by one,
+// which would flood the exporter on a large import.
+func tracedImport(ctx context.Context, name string, run func() (*BatchSummary, error)) (*BatchSummary, error) {
+	_, span := startSpan(ctx, name)
+	summary, err := run()
+	if summary != nil {
+		span.SetAttributes(attribute.Int("import.created", summary.Created))
+		span.SetAttributes(attribute.Int("import.failed", summary.Failed))
+	}
+	endSpan(span, err)
+	return summary, err
+}
+
+// importURLRequest is the body of POST /api/books/import-url
+type importURLRequest struct {
+	URL string `json:"url"`
+}
+
+// handleImportURL serves POST /api/books/import-url, fetching a JSON array
+// of books from an http or https URL and importing it as /api/books/import
+// does. The download is bounded by ImportURLTimeout and ImportURLMaxBytes
+// and read in full before anything is stored, so an oversized catalog
+// imports nothing. Hosts outside ImportURLHosts and private addresses are
+// 403; other failures to fetch are 502, or 504 on timeout.
+func (h *BookHandler) handleImportURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req importURLRequest
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	source, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("url %q must be an absolute http or https URL", req.URL))
+		return
+	}
+	if len(h.ImportURLHosts) > 0 && !slices.Contains(h.ImportURLHosts, strings.ToLower(source.Hostname())) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("host %q is not allowed", source.Hostname()))
+		return
+	}
+
+	body, err := h.fetchCatalog(r.Context(), source.String())
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errBlockedAddress):
+			status = http.StatusForbidden
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusGatewayTimeout
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	summary, err := tracedImport(r.Context(), "BookHandler.ImportURL", func() (*BatchSummary, error) {
+		return importJSONStream(bytes.NewReader(body), h.Service.CreateBook)
+	})
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, summary)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// fetchCatalog downloads source within ImportURLTimeout, failing once the
+// body grows past ImportURLMaxBytes
+func (h *BookHandler) fetchCatalog(ctx context.Context, source string) ([]byte, error) {
+	if h.ImportURLTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.ImportURLTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.ImportURLClient.Do(req)
+	if err != nil {
+		// The cause can describe internal hosts, so it is only logged
+		logger.Warn("failed to fetch catalog", "url", source, "error", err)
+		switch {
+		case errors.Is(err, errBlockedAddress):
+			return nil, fmt.Errorf("%s: %w", source, errBlockedAddress)
+		case errors.Is(err, context.DeadlineExceeded):
+			return nil, fmt.Errorf("fetching %s timed out: %w", source, context.DeadlineExceeded)
+		}
+		return nil, fmt.Errorf("failed to fetch %s", source)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned status %d", source, resp.StatusCode)
+	}
+
+	limit := h.ImportURLMaxBytes
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, fmt.Errorf("%s is %d bytes, at most %d are allowed", source, resp.ContentLength, limit)
+	}
+	reader := io.Reader(resp.Body)
+	if limit > 0 {
+		// One byte over the limit tells an oversized body from one that fits
+		reader = io.LimitReader(resp.Body, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", source, err)
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return nil, fmt.Errorf("%s exceeds %d bytes", source, limit)
+	}
+	return body, nil
+}
+
+// errBlockedAddress is returned when an import URL resolves to an address
+// that is not publicly routable
+var errBlockedAddress = errors.New("address is not publicly routable")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// netip does not count as private
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkPublicAddress is a net.Dialer Control function refusing connections
+// to loopback, private, link-local (including cloud metadata endpoints),
+// multicast and unspecified addresses. It sees the address after DNS
+// resolution, so a public name pointing inward is refused as well.
+func checkPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", errBlockedAddress, ip)
+	}
+	return nil
+}
+
+// newImportURLClient returns the client fetching import URLs: it dials
+// public addresses only, ignores proxy settings that would hide the
+// target address, and does not follow redirects
+func newImportURLClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: checkPublicAddress}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ForceAttemptHTTP2:   true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// importJSONStream reads a JSON array of books from r, calling create for each
+// element as soon as it is decoded. Invalid books are recorded in the summary
+// and skipped; malformed JSON stops the import and is returned as an error.
+func importJSONStream(r io.Reader, create func(*Book) error) (*BatchSummary, error) {
+	summary := &BatchSummary{Results: make([]BatchResult, 0)}
+	fail := func(index int, err error) error {
+		summary.addImportResult(BatchResult{Index: index, Error: err.Error()})
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return summary, fail(0, errors.New("invalid JSON body: expected an array of books"))
+	}
+	for index := 0; dec.More(); index++ {
+		var book Book
+		if err := dec.Decode(&book); err != nil {
+			return summary, fail(index, fmt.Errorf("invalid JSON body: %w", err))
+		}
+		if err := create(&book); err != nil {
+			fail(index, err)
+			continue
+		}
+		summary.addImportResult(BatchResult{Index: index, ID: book.ID})
+	}
+	if _, err := dec.Token(); err != nil {
+		return summary, fail(summary.Created+summary.Failed, fmt.Errorf("invalid JSON body: %w", err))
+	}
+	return summary, nil
+}
+
+// importCSVStream reads CSV with a header row naming the columns from r,
+// calling create for each record as soon as it is read. Columns are matched
+// by name as in exportCSVHeader; id, createdAt, updatedAt and unknown
+// columns are ignored. Invalid books are recorded in the summary and
+// skipped; malformed CSV stops the import and is returned as an error.
+func importCSVStream(r io.Reader, comma rune, create func(*Book) error) (*BatchSummary, error) {
+	summary := &BatchSummary{Results: make([]BatchResult, 0)}
+	line := 0
+	fail := func(index int, err error) error {
+		summary.addImportResult(BatchResult{Index: index, Line: line, Error: err.Error()})
+		return err
+	}
+
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return summary, fail(0, fmt.Errorf("invalid CSV body: expected a header row: %w", err))
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+	for index := 0; ; index++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return summary, nil
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				line = perr.StartLine
+			}
+			return summary, fail(index, fmt.Errorf("invalid CSV body: %w", err))
+		}
+		line, _ = cr.FieldPos(0)
+		book := Book{
+			Title:       field(record, "title"),
+			Author:      field(record, "author"),
+			ISBN:        field(record, "isbn"),
+			Description: field(record, "description"),
+			Genre:       field(record, "genre"),
+		}
+		if year := field(record, "publishedYear"); year != "" {
+			if book.PublishedYear, err = strconv.Atoi(year); err != nil {
+				fail(index, fmt.Errorf("%w: publishedYear %q is not a number", ErrInvalidBook, year))
+				continue
+			}
+		}
+		if err := create(&book); err != nil {
+			fail(index, err)
+			continue
+		}
+		summary.addImportResult(BatchResult{Index: index, Line: line, ID: book.ID})
+	}
+}
+
+// parseDelimiter parses a CSV delimiter parameter, a single character that
+// encoding/csv accepts and that is neither a byte order mark nor a control
+// character other than tab; an empty value means a comma
+func parseDelimiter(value string) (rune, error) {
+	if value == "" {
+		return ',', nil
+	}
+	comma, size := utf8.DecodeRuneInString(value)
+	invalid := size != len(value) || comma == '\uFEFF' || (unicode.IsControl(comma) && comma != '\t')
+	if !invalid {
+		// Defer to encoding/csv for the characters it refuses, such as
+		// quotes, line breaks and NUL
+		cw := csv.NewWriter(io.Discard)
+		cw.Comma = comma
+		invalid = cw.Write(nil) != nil
+	}
+	if invalid {
+		return 0, fmt.Errorf("delimiter must be a single printable character or a tab other than a quote, got %q", value)
+	}
+	return comma, nil
+}
+
+// handleMerge serves POST /api/books/merge
+func (h *BookHandler) handleMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req struct {
+		Keep   string `json:"keep"`
+		Remove string `json:"remove"`
+	}
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	book, err := h.Service.MergeBooks(req.Keep, req.Remove)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, book)
+}
+
+// lookupResponse is the response body of /api/books/lookup
+type lookupResponse struct {
+	Books   []map[string]interface{} `json:"books"`
+	Missing []string                 `json:"missing"`
+}
+
+// handleLookup serves POST /api/books/lookup, fetching the books listed in
+// ids. With fields, each book only carries those JSON fields plus its id;
+// unknown field names are ignored.
+func (h *BookHandler) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req struct {
+		IDs    []string `json:"ids"`
+		Fields []string `json:"fields"`
+	}
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if !h.checkBatchSize(w, len(req.IDs)) {
+		return
+	}
+	books, missing, err := h.Service.GetBooksByIDs(req.IDs)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+
+	resp := lookupResponse{
+		Books:   make([]map[string]interface{}, len(books)),
+		Missing: missing,
+	}
+	if resp.Missing == nil {
+		resp.Missing = []string{}
+	}
+	for i, book := range books {
+		if resp.Books[i], err = projectBook(book, req.Fields); err != nil {
+			h.writeServiceError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// projectBook returns the JSON object of book reduced to fields and id.
+// No fields keeps them all.
+func projectBook(book *Book, fields []string) (map[string]interface{}, error) {
+	data, err := json.Marshal(book)
+	if err != nil {
+		return nil, err
+	}
+	var full map[string]interface{}
+	if err := json.Unmarshal(data, &full); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return full, nil
+	}
+	projected := map[string]interface{}{"id": full["id"]}
+	for _, field := range fields {
+		if v, ok := full[field]; ok {
+			projected[field] = v
+		}
+	}
+	return projected, nil
+}
+
+// genreByAuthorRequest is the request body of /api/books/genre-by-author
+type genreByAuthorRequest struct {
+	Author string `json:"author"`
+	Genre  string `json:"genre"`
+}
+
+// handleGenreByAuthor serves POST /api/books/genre-by-author, setting the
+// genre of every book by one author
+func (h *BookHandler) handleGenreByAuthor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req genreByAuthorRequest
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	updated, err := h.Service.SetGenreByAuthor(req.Author, req.Genre)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"updated": updated})
+}
+
+// handleCategorize serves POST /api/books/categorize
+func (h *BookHandler) handleCategorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req struct {
+		IDs           []string `json:"ids"`
+		Genre         string   `json:"genre"`
+		Transactional bool     `json:"transactional"`
+	}
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if !h.checkBatchSize(w, len(req.IDs)) {
+		return
+	}
+	summary, err := h.Service.CategorizeBooks(req.IDs, req.Genre, req.Transactional)
+	switch {
+	case summary != nil && errors.Is(err, ErrBookNotFound):
+		// The transaction was rolled back; report which IDs caused it
+		writeJSON(w, http.StatusNotFound, summary)
+	case err != nil:
+		h.writeServiceError(w, err)
+	default:
+		writeJSON(w, http.StatusOK, summary)
+	}
+}
+
+// handleDuplicates serves GET /api/books/duplicates?by=isbn|title-author,
+// paging over clusters with offset and limit. X-Total-Count holds the
+// number of clusters and a Link header points to the next page.
+func (h *BookHandler) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	by := query.Get("by")
+	if by == "" {
+		by = DuplicatesByTitleAuthor
+	}
+	limit, err := parseLimit(query.Get("limit"), maxPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, err := parseCount(query.Get("offset"), "offset")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	clusters, err := h.Service.FindDuplicates(by)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	total := len(clusters)
+	start := min(offset, total)
+	clusters = clusters[start:min(start+limit, total)]
+	h.setPageHeaders(w, r, offset, limit, total)
+	writeJSON(w, http.StatusOK, clusters)
+}
+
+// handleIncomplete serves GET /api/books/incomplete[?missing=isbn,year,description]
+func (h *BookHandler) handleIncomplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	var missing []string
+	for _, field := range strings.Split(r.URL.Query().Get("missing"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			missing = append(missing, field)
+		}
+	}
+	books, err := h.Service.FindIncomplete(missing)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, books)
+}
+
+// handleAuthors serves GET /api/books/authors?limit=N, the authors with the most books
+func (h *BookHandler) handleAuthors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultRecentLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	authors, err := h.Service.TopAuthors(limit)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, authors)
+}
+
+// handlePopular serves GET /api/books/popular?limit=N, the most viewed books
+func (h *BookHandler) handlePopular(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultRecentLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	popular, err := h.Service.PopularBooks(limit)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, popular)
+}
+
+// handleChanges serves GET /api/books/changes?since=<token>&limit=N, the
+// change feed. Without since it returns the token to start following from.
+func (h *BookHandler) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"), maxPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	feed, err := h.Service.Changes(query.Get("since"), limit)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, feed)
+}
+
+// handleISBNs serves GET /api/books/isbns: the sorted, distinct ISBNs, or
+// with withIds=true one {isbn, id} pair per book
+func (h *BookHandler) handleISBNs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	withIDs := false
+	if value := r.URL.Query().Get("withIds"); value != "" {
+		var err error
+		if withIDs, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "withIds must be true or false")
+			return
+		}
+	}
+	entries, err := h.Service.ListISBNs()
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	if withIDs {
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+	isbns := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if len(isbns) == 0 || isbns[len(isbns)-1] != entry.ISBN {
+			isbns = append(isbns, entry.ISBN)
+		}
+	}
+	writeJSON(w, http.StatusOK, isbns)
+}
+
+// handleExport serves GET /api/books/export?format=zip|csv[&delimiter=;]:
+// a ZIP archive with one CSV file per author, or a single CSV file. The
+// export is tagged with a strong ETag of its bytes, so an interrupted
+// download can resume with Range and If-Range. A full download is streamed
+// as it is built; only a range request holds the export in memory.
+func (h *BookHandler) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "zip" && format != "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("format must be zip or csv, got %q", format))
+		return
+	}
+	comma, err := parseDelimiter(query.Get("delimiter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	books, err := h.Service.GetAllBooks()
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	books = h.displayBooks(books)
+
+	contentType, fileName := "application/zip", "books.zip"
+	export := func(w io.Writer) error {
+		return writeAuthorZip(w, books, comma)
+	}
+	if format == "csv" {
+		contentType, fileName = "text/csv; charset=utf-8", "books.csv"
+		sortBooksByID(books)
+		export = func(w io.Writer) error {
+			return writeBooksCSV(w, books, comma)
+		}
+	}
+
+	// The export is built from one snapshot of the books, so every build
+	// has the same bytes: a first pass only hashes them for the ETag
+	hash := sha256.New()
+	if err := export(hash); err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+		if err := export(w); err != nil {
+			// The status is already sent; the client sees a cut-off body
+			logger.Warn("failed to stream export", "format", format, "error", err)
+		}
+		return
+	}
+
+	var body bytes.Buffer
+	if err := export(&body); err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	// ServeContent answers Range (with Accept-Ranges: bytes), If-Range and
+	// If-None-Match; its plain-text errors are rewritten as JSON
+	jw := &jsonErrorWriter{ResponseWriter: w}
+	http.ServeContent(jw, r, "", time.Time{}, bytes.NewReader(body.Bytes()))
+	jw.finish()
+}
+
+// exportCSVHeader is the header row of the exported CSV files
+var exportCSVHeader = []string{"id", "title", "author", "publishedYear", "isbn", "description", "genre", "createdAt", "updatedAt"}
+
+// writeBooksCSV writes a header row and one record per book, separated by comma
+func writeBooksCSV(w io.Writer, books []*Book, comma rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	if err := cw.Write(exportCSVHeader); err != nil {
+		return err
+	}
+	for _, b := range books {
+		err := cw.Write([]string{
+			b.ID, b.Title, b.Author, strconv.Itoa(b.PublishedYear), b.ISBN, b.Description, b.Genre,
+			b.CreatedAt.Format(time.RFC3339), b.UpdatedAt.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeAuthorZip writes books as a ZIP archive holding one CSV per author,
+// in author order, each listing the author's books in ID order
+func writeAuthorZip(w io.Writer, books []*Book, comma rune) error {
+	byAuthor := make(map[string][]*Book)
+	for _, book := range books {
+		byAuthor[book.Author] = append(byAuthor[book.Author], book)
+	}
+	authors := make([]string, 0, len(byAuthor))
+	for author := range byAuthor {
+		authors = append(authors, author)
+	}
+	sort.Strings(authors)
+
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool, len(authors))
+	for _, author := range authors {
+		name := exportFileName(author, used)
+		entry, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		group := byAuthor[author]
+		sortBooksByID(group)
+		if err := writeBooksCSV(entry, group, comma); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// exportFileName turns an author into a unique, safe file name: anything
+// but letters, digits, dots, hyphens and underscores becomes an underscore,
+// and clashes get a numeric suffix
+func exportFileName(author string, used map[string]bool) string {
+	base := strings.Trim(strings.Map(func(c rune) rune {
+		if c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)) || strings.ContainsRune(".-_", c) {
+			return c
+		}
+		return '_'
+	}, author), "._")
+	if base == "" {
+		base = "unknown"
+	}
+	name := base + ".csv"
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d.csv", base, i)
+	}
+	used[name] = true
+	return name
+}
+
+// handleByAuthor serves GET /api/books/by-author?offset=N&limit=N&perAuthor=N,
+// paging over authors. X-Total-Count holds the number of authors and a
+// Link header points to the next page while there is one.
+func (h *BookHandler) handleByAuthor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	limit, err := parseLimit(query.Get("limit"), maxPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, err := parseCount(query.Get("offset"), "offset")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	perAuthor, err := parseCount(query.Get("perAuthor"), "perAuthor")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	groups, total, err := h.Service.GroupByAuthor(offset, limit, perAuthor)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	h.setPageHeaders(w, r, offset, limit, total)
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// setPageHeaders sets X-Total-Count to total and, while items remain after
+// this page, a Link header pointing to the next page
+func (h *BookHandler) setPageHeaders(w http.ResponseWriter, r *http.Request, offset, limit, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next := offset + limit; next < total {
+		query := r.URL.Query()
+		query.Set("offset", strconv.Itoa(next))
+		query.Set("limit", strconv.Itoa(limit))
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, h.absoluteURL(r, r.URL.Path+"?"+query.Encode())))
+	}
+}
+
+// handleRecent serves GET /api/books/recent?limit=N
+func (h *BookHandler) handleRecent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	limit, err := parseLimit(r.URL.Query().Get("limit"), defaultRecentLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	books, err := h.Service.GetRecentBooks(limit)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, books)
+}
+
+// handleResolve serves GET /api/books/resolve/{key}, where key is a book ID or an ISBN
+func (h *BookHandler) handleResolve(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	book, matchedBy, err := h.Service.ResolveBook(key)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		MatchedBy string `json:"matchedBy"`
+		Book      *Book  `json:"book"`
+	}{matchedBy, book})
+}
+
+// isbnValidation is the response body of GET /api/books/validate-isbn/{isbn}
+type isbnValidation struct {
+	Valid      bool   `json:"valid"`
+	Normalized string `json:"normalized,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// handleValidateISBN serves GET /api/books/validate-isbn/{isbn}; nothing is stored
+func (h *BookHandler) handleValidateISBN(w http.ResponseWriter, r *http.Request, isbn string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	normalized, kind, err := checkISBN(isbn)
+	if err != nil {
+		writeJSON(w, http.StatusOK, isbnValidation{Reason: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, isbnValidation{Valid: true, Normalized: normalized, Type: kind})
+}
+
+// handleByDecade serves GET /api/books/by-decade[?includeEmpty=true]
+func (h *BookHandler) handleByDecade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	includeEmpty := false
+	if value := r.URL.Query().Get("includeEmpty"); value != "" {
+		var err error
+		if includeEmpty, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "includeEmpty must be true or false")
+			return
+		}
+	}
+	buckets, err := h.Service.CountByDecade(includeEmpty)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, buckets)
+}
+
+// handleIndex serves GET /api/books/index?field=title|author[&ids=true]
+func (h *BookHandler) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	field := query.Get("field")
+	if field == "" {
+		field = "title"
+	}
+	withIDs := false
+	if value := query.Get("ids"); value != "" {
+		var err error
+		if withIDs, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "ids must be true or false")
+			return
+		}
+	}
+	index, err := h.Service.IndexByInitial(field, withIDs)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, index)
+}
+
+// handleQuality serves GET /api/books/quality
+func (h *BookHandler) handleQuality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	report, err := h.Service.Quality()
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleExtremes serves GET /api/books/extremes
+func (h *BookHandler) handleExtremes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	oldest, newest, err := h.Service.GetExtremes()
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]*Book{"oldest": oldest, "newest": newest})
+}
+
+// handleSearch serves /api/books/search. Given both author and title it
+// returns the books matching both; before the combined search existed the
+// title was ignored when an author was given.
+func (h *BookHandler) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+	author, title := query.Get("author"), query.Get("title")
+	description := strings.TrimSpace(query.Get("description"))
+	if query.Has("description") && description == "" {
+		writeError(w, http.StatusBadRequest, "description query parameter must not be empty")
+		return
+	}
+	for _, term := range []struct{ name, value string }{{"author", author}, {"title", title}, {"description", description}} {
+		if n := utf8.RuneCountInString(term.value); h.MaxSearchTerm > 0 && n > h.MaxSearchTerm {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s search term has %d characters, at most %d are allowed", term.name, n, h.MaxSearchTerm))
+			return
+		}
+	}
+	isbnPrefix := query.Get("isbnPrefix")
+	genre := query.Get("genre")
+	ctx := r.Context()
+	if h.SearchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.SearchTimeout)
+		defer cancel()
+	}
+	if value := query.Get("fuzzy"); value != "" {
+		fuzzy, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "fuzzy must be true or false")
+			return
+		}
+		if fuzzy {
+			h.fuzzySearch(ctx, w, query)
+			return
+		}
+	}
+	var (
+		books []*Book
+		err   error
+	)
+	switch {
+	case author != "" && title != "":
+		// Combined search: books matching both the author and the title
+		books, err = h.Service.SearchBooksByAuthorContext(ctx, author)
+		books = filterBooks(books, func(b *Book) bool { return containsFold(b.Title, title) })
+	case author != "":
+		books, err = h.Service.SearchBooksByAuthorContext(ctx, author)
+	case title != "":
+		books, err = h.Service.SearchBooksByTitleContext(ctx, title)
+	case description != "":
+		books, err = h.Service.SearchBooksByDescriptionContext(ctx, description)
+	case query.Has("isbnPrefix"):
+		books, err = h.Service.SearchBooksByISBNPrefixContext(ctx, isbnPrefix)
+	case genre != "":
+		books, err = h.Service.SearchBooksByGenre(genre)
+	default:
+		writeError(w, http.StatusBadRequest, "author, title, description, isbnPrefix or genre query parameter is required")
+		return
+	}
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	if description != "" && (author != "" || title != "") {
+		words := strings.Fields(description)
+		books = filterBooks(books, func(b *Book) bool { return containsAllFold(b.Description, words) })
+	}
+	if isbnPrefix != "" && (author != "" || title != "" || description != "") {
+		// Validate the prefix and narrow the matches by it
+		byPrefix, err := h.Service.SearchBooksByISBNPrefixContext(ctx, isbnPrefix)
+		if err != nil {
+			h.writeServiceError(w, err)
+			return
+		}
+		ids := make(map[string]bool, len(byPrefix))
+		for _, b := range byPrefix {
+			ids[b.ID] = true
+		}
+		books = filterBooks(books, func(b *Book) bool { return ids[b.ID] })
+	}
+	if genre != "" && (author != "" || title != "" || description != "" || query.Has("isbnPrefix")) {
+		// Narrow the matches by the genre index
+		byGenre, err := h.Service.SearchBooksByGenre(genre)
+		if err != nil {
+			h.writeServiceError(w, err)
+			return
+		}
+		ids := make(map[string]bool, len(byGenre))
+		for _, b := range byGenre {
+			ids[b.ID] = true
+		}
+		books = filterBooks(books, func(b *Book) bool { return ids[b.ID] })
+	}
+	h.writeSearchResults(w, books)
+}
+
+// fuzzySearch serves GET /api/books/search?fuzzy=true with exactly one of
+// title or author, ranking matches by edit distance
+func (h *BookHandler) fuzzySearch(ctx context.Context, w http.ResponseWriter, query url.Values) {
+	var field string
+	for _, name := range []string{"title", "author"} {
+		if query.Get(name) == "" {
+			continue
+		}
+		if field != "" {
+			writeError(w, http.StatusBadRequest, "fuzzy search takes either title or author, not both")
+			return
+		}
+		field = name
+	}
+	if field == "" {
+		writeError(w, http.StatusBadRequest, "fuzzy search requires a title or author query parameter")
+		return
+	}
+	books, truncated, err := h.Service.FuzzySearch(ctx, field, query.Get(field), h.FuzzyMaxDistance, h.FuzzyMaxCandidates)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	if truncated {
+		w.Header().Set("X-Result-Truncated", "true")
+	}
+	h.writeSearchResults(w, books)
+}
+
+// writeSearchResults writes search matches, honoring EmptySearch404 and
+// MaxSearchResults. Matches arrive in ranked order (currently by ID), so a
+// truncated response holds the best-ranked matches; sorting only applies to
+// what is kept. X-Result-Truncated tells clients that more matches exist.
+// More than SearchSummaryThreshold matches are written as summaries,
+// flagged with X-Result-Summarized, to keep broad searches light.
+func (h *BookHandler) writeSearchResults(w http.ResponseWriter, books []*Book) {
+	if len(books) == 0 && h.EmptySearch404 {
+		writeError(w, http.StatusNotFound, "no books match the search")
+		return
+	}
+	if h.MaxSearchResults > 0 && len(books) > h.MaxSearchResults {
+		books = books[:h.MaxSearchResults]
+		w.Header().Set("X-Result-Truncated", "true")
+	}
+	if h.SearchSummaryThreshold > 0 && len(books) > h.SearchSummaryThreshold {
+		summaries := make([]BookSummary, len(books))
+		for i, book := range books {
+			summaries[i] = NewBookSummary(book)
+		}
+		w.Header().Set("X-Result-Summarized", "true")
+		writeJSON(w, http.StatusOK, summaries)
+		return
+	}
+	writeJSON(w, http.StatusOK, books)
+}
+
+// handleItem serves /api/books/{id}
+func (h *BookHandler) handleItem(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getBook(w, r, id)
+	case http.MethodPut:
+		h.updateBook(w, r, id)
+	case http.MethodPatch:
+		h.patchBook(w, r, id)
+	case http.MethodDelete:
+		h.deleteBook(w, r, id)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// handleItemAction serves POST /api/books/{id}/{action}
+func (h *BookHandler) handleItemAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	var handle func(http.ResponseWriter, *http.Request, string)
+	switch action {
+	case "reassign":
+		handle = h.reassignBook
+	case "increment":
+		handle = h.incrementBook
+	case "touch":
+		handle = h.touchBook
+	case "pop":
+		handle = h.popBook
+	default:
+		writeError(w, http.StatusNotFound, "unknown book action")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	handle(w, r, id)
+}
+
+// reassignBook serves POST /api/books/{id}/reassign
+func (h *BookHandler) reassignBook(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		NewID string `json:"newId"`
+	}
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	book, err := h.Service.ReassignBookID(id, req.NewID)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, book)
+}
+
+// incrementRequest is the body of POST /api/books/{id}/increment
+type incrementRequest struct {
+	Field string `json:"field"`
+	Delta int    `json:"delta"`
+}
+
+// incrementResponse reports the new value of an incremented field
+type incrementResponse struct {
+	ID    string `json:"id"`
+	Field string `json:"field"`
+	Value int    `json:"value"`
+}
+
+// incrementBook serves POST /api/books/{id}/increment
+func (h *BookHandler) incrementBook(w http.ResponseWriter, r *http.Request, id string) {
+	var req incrementRequest
+	if err := h.decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	value, err := h.Service.IncrementField(id, req.Field, req.Delta)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, incrementResponse{ID: id, Field: req.Field, Value: value})
+}
+
+// touchBook serves POST /api/books/{id}/touch
+func (h *BookHandler) touchBook(w http.ResponseWriter, r *http.Request, id string) {
+	book, err := h.Service.TouchBook(id)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, book)
+}
+
+// popBook serves POST /api/books/{id}/pop
+func (h *BookHandler) popBook(w http.ResponseWriter, r *http.Request, id string) {
+	book, err := h.Service.PopBook(id)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, book)
+}
+
+// getBook serves GET /api/books/{id}, with ?withHistory=true the book or
+// its tombstone together with its audit history
+func (h *BookHandler) getBook(w http.ResponseWriter, r *http.Request, id string) {
+	if value := r.URL.Query().Get("withHistory"); value != "" {
+		withHistory, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "withHistory must be true or false")
+			return
+		}
+		if withHistory {
+			h.getBookWithHistory(w, id)
+			return
+		}
+	}
+	mediaType, ok := negotiateBookVersion(w, r)
+	if !ok {
+		return
+	}
+	book, err := h.Service.GetBookByIDContext(r.Context(), id)
+	if errors.Is(err, ErrBookNotFound) && h.MissingAsEmpty {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeBook(w, http.StatusOK, mediaType, book)
+}
+
+// getBookWithHistory serves GET /api/books/{id}?withHistory=true
+func (h *BookHandler) getBookWithHistory(w http.ResponseWriter, id string) {
+	result, err := h.Service.BookHistory(id)
+	if err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// updateBook serves PUT /api/books/{id}
+func (h *BookHandler) updateBook(w http.ResponseWriter, r *http.Request, id string) {
+	var book Book
+	if err := h.decodeJSON(r, &book); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if book.ID != "" && book.ID != id {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("body id %q does not match path id %q; use POST /api/books/%s/reassign to change an ID", book.ID, id, id))
+		return
+	}
+	if err := h.Service.UpdateBookContext(r.Context(), id, &book); err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, book)
+}
+
+// patchBook serves PATCH /api/books/{id}, changing only the fields present
+// in the body. Whether an unknown ID is created (201) or reported as 404
+// follows PatchUpsert unless the X-Upsert header says otherwise; a created
+// book missing required fields is rejected with 422.
+func (h *BookHandler) patchBook(w http.ResponseWriter, r *http.Request, id string) {
+	upsert := h.PatchUpsert
+	if value := r.Header.Get("X-Upsert"); value != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "X-Upsert must be true or false")
+			return
+		}
+	}
+
+	var decodeErr error
+	book, created, err := h.Service.PatchBookContext(r.Context(), id, upsert, func(b *Book) error {
+		decodeErr = h.decodeJSON(r, b)
+		return decodeErr
+	})
+	var verr *ValidationError
+	switch {
+	case decodeErr != nil:
+		writeDecodeError(w, decodeErr)
+	case created && errors.As(err, &verr):
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error(), Fields: verr.Fields})
+	case err != nil:
+		h.writeServiceError(w, err)
+	case created:
+		w.Header().Set("Location", h.absoluteURL(r, "/api/books/"+url.PathEscape(book.ID)))
+		writeJSON(w, http.StatusCreated, book)
+	default:
+		writeJSON(w, http.StatusOK, book)
+	}
+}
+
+// deleteBook serves DELETE /api/books/{id}
+func (h *BookHandler) deleteBook(w http.ResponseWriter, r *http.Request, id string) {
+	if err := h.Service.DeleteBookContext(r.Context(), id); err != nil {
+		h.writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "book deleted"})
+}
+
+// Page size limits for endpoints taking a limit parameter
+const (
+	defaultRecentLimit = 10
+	maxPageSize        = 100
+)
+
+// parseLimit parses a limit parameter, applying def when empty and capping
+// the result at maxPageSize
+func parseLimit(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// parseCount parses a non-negative integer parameter such as an offset,
+// treating an empty value as 0
+func parseCount(value, name string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// Search limits applied unless configured otherwise
+const (
+	defaultMaxSearchResults = 1000
+	defaultSearchTimeout    = 10 * time.Second
+	defaultMaxSearchTerm    = 256
+
+	defaultFuzzyMaxDistance   = 2
+	defaultFuzzyMaxCandidates = 10000
+)
+
+// Request size limits applied unless configured otherwise
+const (
+	defaultMaxBatchItems = 500
+	defaultMaxBodyBytes  = 1 << 20
+)
+
+// Bounds on catalogs fetched by /api/books/import-url
+const (
+	defaultImportURLTimeout  = 30 * time.Second
+	defaultImportURLMaxBytes = 10 << 20
+)
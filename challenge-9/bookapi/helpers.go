@@ -0,0 +1,389 @@
+package bookapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// copyBook returns a shallow copy so callers never share stored pointers
+func copyBook(book *Book) *Book {
+	c := *book
+	return &c
+}
+
+// sortBooksByID orders books by numeric ID, falling back to string order
+func sortBooksByID(books []*Book) {
+	sort.Slice(books, func(i, j int) bool {
+		return lessID(books[i].ID, books[j].ID)
+	})
+}
+
+// bookSortFields are the comparison functions for the sort parameter
+var bookSortFields = map[string]func(a, b *Book) bool{
+	"id":     func(a, b *Book) bool { return lessID(a.ID, b.ID) },
+	"title":  func(a, b *Book) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) },
+	"author": func(a, b *Book) bool { return strings.ToLower(a.Author) < strings.ToLower(b.Author) },
+	"year":   func(a, b *Book) bool { return a.PublishedYear < b.PublishedYear },
+}
+
+// validateSortSpec checks a sort parameter such as "title" or "-year"
+func validateSortSpec(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	if _, ok := bookSortFields[strings.TrimPrefix(spec, "-")]; !ok {
+		return fmt.Errorf("invalid sort %q: must be id, title, author or year, optionally prefixed with -", spec)
+	}
+	return nil
+}
+
+// sortBooks orders books by a validated sort spec; a leading - sorts descending.
+// The sort is stable, so books that compare equal keep their ID order.
+func sortBooks(books []*Book, spec string) {
+	if spec == "" {
+		return
+	}
+	desc := strings.HasPrefix(spec, "-")
+	less := bookSortFields[strings.TrimPrefix(spec, "-")]
+	sort.SliceStable(books, func(i, j int) bool {
+		if desc {
+			return less(books[j], books[i])
+		}
+		return less(books[i], books[j])
+	})
+}
+
+// lessID compares IDs numerically when both are numbers
+func lessID(a, b string) bool {
+	ai, errA := strconv.Atoi(a)
+	bi, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return ai < bi
+	}
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	return a < b
+}
+
+// isNil reports whether v is nil or an interface holding a nil pointer
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// filterBooks returns the books matching the predicate
+func filterBooks(books []*Book, match func(*Book) bool) []*Book {
+	filtered := make([]*Book, 0, len(books))
+	for _, book := range books {
+		if match(book) {
+			filtered = append(filtered, book)
+		}
+	}
+	return filtered
+}
+
+// containsFold reports whether substr is within s, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// containsAllFold reports whether s contains every word, ignoring case
+func containsAllFold(s string, words []string) bool {
+	for _, word := range words {
+		if !containsFold(s, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeISBN strips hyphens and spaces and upper-cases the X check digit
+func normalizeISBN(isbn string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+}
+
+// ISBN kinds reported by checkISBN
+const (
+	isbnKind10 = "isbn10"
+	isbnKind13 = "isbn13"
+)
+
+// checkISBN normalizes isbn and verifies its length, digits and check digit,
+// returning the normalized form and whether it is an ISBN-10 or ISBN-13
+func checkISBN(isbn string) (normalized, kind string, err error) {
+	normalized = normalizeISBN(isbn)
+	switch len(normalized) {
+	case 10:
+		sum := 0
+		for i, c := range normalized {
+			var d int
+			switch {
+			case c >= '0' && c <= '9':
+				d = int(c - '0')
+			case c == 'X' && i == 9:
+				d = 10
+			default:
+				return "", "", fmt.Errorf("ISBN-10 may only contain digits and a trailing X")
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", "", fmt.Errorf("invalid ISBN-10 checksum")
+		}
+		return normalized, isbnKind10, nil
+	case 13:
+		sum := 0
+		for i, c := range normalized {
+			if c < '0' || c > '9' {
+				return "", "", fmt.Errorf("ISBN-13 may only contain digits")
+			}
+			d := int(c - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		if sum%10 != 0 {
+			return "", "", fmt.Errorf("invalid ISBN-13 checksum")
+		}
+		return normalized, isbnKind13, nil
+	default:
+		return "", "", fmt.Errorf("ISBN must have 10 or 13 characters, got %d", len(normalized))
+	}
+}
+
+// dsnPasswordParam matches a password given as a key/value pair, as in
+// "host=db password=secret" or "?password=secret&sslmode=require", with
+// the value optionally single-quoted
+var dsnPasswordParam = regexp.MustCompile(`(?i)\b(password|passwd|pwd|sslpassword)(\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&;]+)`)
+
+// redactedPassword replaces passwords in redacted DSNs, as in url.Redacted
+const redactedPassword = "xxxxx"
+
+// redactDSN hides the passwords of a DSN: key/value password pairs, the
+// user info of a URL-style DSN and that of a MySQL-style
+// "user:pass@tcp(host)/db" DSN. Anything else, such as a file path, is
+// returned unchanged.
+func redactDSN(dsn string) string {
+	dsn = dsnPasswordParam.ReplaceAllString(dsn, "${1}${2}"+redactedPassword)
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			// Do not risk showing a password the parser could not find
+			scheme, _, _ := strings.Cut(dsn, "://")
+			return scheme + "://" + redactedPassword
+		}
+		if _, ok := u.User.Password(); !ok {
+			return dsn
+		}
+		return u.Redacted()
+	}
+	// MySQL DSNs end with "/dbname" and the password may itself contain
+	// "@", so the user info ends at the last "@" before the last "/"
+	end := strings.LastIndex(dsn, "/")
+	if end < 0 {
+		end = len(dsn)
+	}
+	at := strings.LastIndex(dsn[:end], "@")
+	if at < 0 {
+		return dsn
+	}
+	colon := strings.IndexByte(dsn[:at], ':')
+	if colon < 0 {
+		return dsn
+	}
+	return dsn[:colon+1] + redactedPassword + dsn[at:]
+}
+
+// normalizeName reduces an author or title to lower-case letters and digits,
+// dropping punctuation and spacing variants such as "J.R.R." vs "JRR"
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// Author display formats for --author-format
+const (
+	authorFormatAsEntered = "as-entered"
+	authorFormatLastFirst = "last-first"
+)
+
+// authorFormats maps each author display format to its transform; nil
+// leaves authors as entered
+var authorFormats = map[string]func(string) string{
+	"":                    nil,
+	authorFormatAsEntered: nil,
+	authorFormatLastFirst: lastFirst,
+}
+
+// authorDisplayWriter is the ResponseWriter HandleBooks hands on when an
+// author format is set; encodeJSON applies format to what it writes
+type authorDisplayWriter struct {
+	http.ResponseWriter
+	format func(string) string
+}
+
+// jsonLevel is an open object or array while displayAuthors rewrites a
+// document
+type jsonLevel struct {
+	object    bool
+	expectKey bool
+	key       string
+	count     int
+}
+
+// displayAuthors rewrites the string value of every "author" key in the
+// JSON document data with formatAuthors, keeping everything else, key
+// order included, as encoded
+func displayAuthors(data []byte, format func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	var stack []*jsonLevel
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			out.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		var parent *jsonLevel
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+			if parent.count > 0 && (!parent.object || parent.expectKey) {
+				out.WriteByte(',')
+			}
+			if parent.object && parent.expectKey {
+				parent.key, _ = tok.(string)
+				parent.expectKey = false
+				parent.count++
+				encoded, _ := json.Marshal(parent.key)
+				out.Write(encoded)
+				out.WriteByte(':')
+				continue
+			}
+			parent.expectKey = parent.object
+			if !parent.object {
+				parent.count++
+			}
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(t))
+			stack = append(stack, &jsonLevel{object: t == '{', expectKey: t == '{'})
+		case json.Number:
+			out.WriteString(t.String())
+		case string:
+			if parent != nil && parent.object && parent.key == "author" {
+				t = formatAuthors(t, format)
+			}
+			encoded, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(encoded)
+		default:
+			encoded, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(encoded)
+		}
+	}
+}
+
+// displayBooks returns books with authors in the AuthorFormat display form.
+// Changed books are copies; with no transform books is returned as is.
+func (h *BookHandler) displayBooks(books []*Book) []*Book {
+	format := authorFormats[h.AuthorFormat]
+	if format == nil {
+		return books
+	}
+	display := make([]*Book, len(books))
+	for i, book := range books {
+		display[i] = copyBook(book)
+		display[i].Author = formatAuthors(book.Author, format)
+	}
+	return display
+}
+
+// nameParticles are words, in lower case, that belong to the surname that
+// follows them, as in "Vincent van Gogh" or "Ursula K. Le Guin"
+var nameParticles = map[string]bool{
+	"van": true, "von": true, "der": true, "den": true, "de": true, "del": true, "della": true,
+	"da": true, "di": true, "du": true, "la": true, "le": true, "bin": true, "ibn": true, "al": true,
+}
+
+// nameSuffixes are generational suffixes kept after the given names, as
+// in "King, Martin Luther, Jr."
+var nameSuffixes = map[string]bool{"jr": true, "jr.": true, "sr": true, "sr.": true, "ii": true, "iii": true, "iv": true}
+
+// formatAuthors applies format to each author listed in author
+func formatAuthors(author string, format func(string) string) string {
+	names := splitAuthors(author)
+	if len(names) < 2 {
+		return format(author)
+	}
+	for i, name := range names {
+		names[i] = format(name)
+	}
+	return strings.Join(names, authorSeparator+" ")
+}
+
+// authorGroupKey is the form under which author names are grouped and
+// counted: lower case without surrounding spaces
+func authorGroupKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// lastFirst turns "First Last" into "Last, First", keeping name particles
+// with the surname and moving a suffix to the end. Single names and names
+// that already contain a comma are returned unchanged.
+func lastFirst(name string) string {
+	words := strings.Fields(name)
+	if strings.Contains(name, ",") || len(words) < 2 {
+		return name
+	}
+	suffix := ""
+	if last := words[len(words)-1]; nameSuffixes[strings.ToLower(last)] && len(words) > 2 {
+		suffix, words = last, words[:len(words)-1]
+	}
+	start := len(words) - 1
+	for start > 1 && nameParticles[strings.ToLower(words[start-1])] {
+		start--
+	}
+	formatted := strings.Join(words[start:], " ") + ", " + strings.Join(words[:start], " ")
+	if suffix != "" {
+		formatted += ", " + suffix
+	}
+	return formatted
+}
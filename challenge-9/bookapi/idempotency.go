@@ -0,0 +1,192 @@
+package bookapi
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for the idempotency key store
+const (
+	defaultIdempotencyTTL     = 24 * time.Hour
+	defaultIdempotencyMaxKeys = 10000
+)
+
+// ErrIdempotencyKeyReused is returned when a key is sent again with a different body
+var ErrIdempotencyKeyReused = errors.New("Idempotency-Key was already used with a different request body")
+
+// idempotencyEntry is the response for one Idempotency-Key. While the
+// first request runs, response is nil and later ones wait for done.
+type idempotencyEntry struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	response    *responseBuffer
+	expires     time.Time
+	// index is the entry's position in the expiry heap, -1 while pending
+	index int
+}
+
+// idempotencyExpiry is a min-heap of stored entries by expiry
+type idempotencyExpiry []*idempotencyEntry
+
+func (h idempotencyExpiry) Len() int           { return len(h) }
+func (h idempotencyExpiry) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h idempotencyExpiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *idempotencyExpiry) Push(x interface{}) {
+	entry := x.(*idempotencyEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *idempotencyExpiry) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// IdempotencyStore remembers create responses per Idempotency-Key for a TTL.
+// It holds at most maxKeys stored entries, evicting the ones closest to
+// expiry first.
+type IdempotencyStore struct {
+	ttl     time.Duration
+	maxKeys int
+	clock   Clock
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	expiry  idempotencyExpiry
+}
+
+// NewIdempotencyStore creates a store keeping responses for ttl
+func NewIdempotencyStore(ttl time.Duration, maxKeys int) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		clock:   realClock{},
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// Do returns the stored response for key, or runs fn and stores its response.
+// Only the key is locked while fn runs: concurrent retries with the same key
+// wait for the first to finish rather than both creating, while other keys
+// proceed. Server errors are not stored so the client can retry them.
+func (s *IdempotencyStore) Do(key string, body []byte, fn func() *responseBuffer) (*responseBuffer, error) {
+	fingerprint := sha256.Sum256(body)
+
+	s.mu.Lock()
+	for {
+		entry, ok := s.entries[key]
+		if !ok {
+			break
+		}
+		if entry.response == nil {
+			if entry.fingerprint != fingerprint {
+				s.mu.Unlock()
+				return nil, ErrIdempotencyKeyReused
+			}
+			s.mu.Unlock()
+			<-entry.done
+			s.mu.Lock()
+			continue
+		}
+		if !s.clock.Now().Before(entry.expires) {
+			break
+		}
+		s.mu.Unlock()
+		if entry.fingerprint != fingerprint {
+			return nil, ErrIdempotencyKeyReused
+		}
+		return entry.response, nil
+	}
+	s.evict(s.clock.Now())
+	entry := &idempotencyEntry{key: key, fingerprint: fingerprint, done: make(chan struct{}), index: -1}
+	s.entries[key] = entry
+	s.mu.Unlock()
+
+	var resp *responseBuffer
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// A panic in fn leaves resp nil; waiters then run fn themselves
+		if resp == nil || resp.status >= http.StatusInternalServerError {
+			delete(s.entries, key)
+		} else {
+			s.evict(s.clock.Now())
+			entry.response = resp
+			entry.expires = s.clock.Now().Add(s.ttl)
+			heap.Push(&s.expiry, entry)
+		}
+		close(entry.done)
+	}()
+	resp = fn()
+	return resp, nil
+}
+
+// evict drops expired entries and, if still full, the entries expiring
+// soonest, taking them from the expiry heap. Pending entries are never
+// evicted. The caller must hold s.mu.
+func (s *IdempotencyStore) evict(now time.Time) {
+	for len(s.expiry) > 0 && !now.Before(s.expiry[0].expires) {
+		s.drop(heap.Pop(&s.expiry).(*idempotencyEntry))
+	}
+	for s.maxKeys > 0 && len(s.expiry) > 0 && len(s.expiry) >= s.maxKeys {
+		s.drop(heap.Pop(&s.expiry).(*idempotencyEntry))
+	}
+}
+
+// drop removes an entry taken off the expiry heap unless its key has since
+// been taken by a newer entry. The caller must hold s.mu.
+func (s *IdempotencyStore) drop(entry *idempotencyEntry) {
+	if s.entries[entry.key] == entry {
+		delete(s.entries, entry.key)
+	}
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response in memory
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newResponseBuffer creates an empty responseBuffer
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), status: http.StatusOK}
+}
+
+// Header returns the buffered response headers
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+// WriteHeader records the response status
+func (b *responseBuffer) WriteHeader(status int) {
+	b.status = status
+}
+
+// Write appends to the buffered body
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// writeTo sends the buffered response to w
+func (b *responseBuffer) writeTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
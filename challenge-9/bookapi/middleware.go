@@ -0,0 +1,777 @@
+package bookapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// logger is the package-wide structured logger, configured once in Main
+var logger = slog.Default()
+
+// newLogger builds a logger writing to w at the given level and format
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	lvl := new(slog.LevelVar)
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	return newLeveledLogger(w, lvl, format)
+}
+
+// newLeveledLogger builds a logger whose level follows lvl, so it can be
+// changed while the server runs
+func newLeveledLogger(w io.Writer, lvl slog.Leveler, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// statusRecorder captures the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader records the status before passing it on
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.size += n
+	return n, err
+}
+
+// LoggingMiddleware logs a summary of every request at info level,
+// and the request and response details at debug level
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		logger.Debug("request received",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+			"content_length", r.ContentLength,
+		)
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(start)
+		logger.Debug("response sent",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.size,
+			"content_type", rec.Header().Get("Content-Type"),
+			"duration", elapsed,
+		)
+		logger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", elapsed,
+		)
+	})
+}
+
+// SlowRequestMiddleware logs a warning for every request that takes longer
+// than threshold, so outliers stand out from the regular request log
+func SlowRequestMiddleware(threshold time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if elapsed := time.Since(start); elapsed > threshold {
+			logger.Warn("slow request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.status,
+				"duration", elapsed,
+				"threshold", threshold,
+			)
+		}
+	})
+}
+
+// concurrencyRetryAfter is the Retry-After value, in seconds, sent when
+// too many requests are in flight
+const concurrencyRetryAfter = "1"
+
+// ConcurrencyLimitMiddleware serves at most limit requests at a time.
+// Requests beyond that are rejected at once with 503 and Retry-After
+// instead of queueing up.
+func ConcurrencyLimitMiddleware(limit int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", concurrencyRetryAfter)
+			writeError(w, http.StatusServiceUnavailable, "too many requests in flight")
+		}
+	})
+}
+
+// URL limits applied unless configured otherwise
+const (
+	defaultMaxURLLength   = 8192
+	defaultMaxQueryParams = 100
+)
+
+// URLLimitMiddleware rejects requests whose raw URL is longer than maxLength
+// bytes with 414, and requests with more than maxParams query values,
+// counting repeated names once per value, with 400. A limit of 0 disables
+// that check.
+func URLLimitMiddleware(maxLength, maxParams int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(r.URL.RequestURI()); maxLength > 0 && n > maxLength {
+			writeError(w, http.StatusRequestURITooLong, fmt.Sprintf("URL has %d bytes, at most %d are allowed", n, maxLength))
+			return
+		}
+		if maxParams > 0 {
+			n := 0
+			for _, values := range r.URL.Query() {
+				n += len(values)
+			}
+			if n > maxParams {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("request has %d query parameters, at most %d are allowed", n, maxParams))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// defaultSlowRequestThreshold is the duration beyond which requests are
+// logged as slow unless configured otherwise
+const defaultSlowRequestThreshold = time.Second
+
+// publicPaths are served without an API key
+var publicPaths = map[string]bool{
+	"/healthz":      true,
+	"/openapi.json": true,
+}
+
+// APIKeyMiddleware rejects requests that do not carry a valid API key in header.
+// Missing keys get 401 and unknown keys get 403; publicPaths are exempt.
+func APIKeyMiddleware(header string, keys []string, next http.Handler) http.Handler {
+	hashes := make([][sha256.Size]byte, len(keys))
+	for i, key := range keys {
+		hashes[i] = sha256.Sum256([]byte(key))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get(header)
+		if key == "" {
+			writeError(w, http.StatusUnauthorized, "missing API key")
+			return
+		}
+
+		// Hashing gives fixed-length inputs, and every key is checked so the
+		// timing does not reveal which one (if any) matched.
+		sum := sha256.Sum256([]byte(key))
+		valid := 0
+		for i := range hashes {
+			valid |= subtle.ConstantTimeCompare(sum[:], hashes[i][:])
+		}
+		if valid != 1 {
+			writeError(w, http.StatusForbidden, "invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Problem is an RFC 7807 problem details object. Field errors and the
+// internal error ID are carried as extension members.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	ErrorID  string       `json:"errorId,omitempty"`
+}
+
+// problemTypes names the problem type of each error status; the typed
+// service errors map onto these statuses in writeServiceError
+var problemTypes = map[int]string{
+	http.StatusBadRequest:          "/problems/invalid-request",
+	http.StatusUnauthorized:        "/problems/unauthorized",
+	http.StatusForbidden:           "/problems/forbidden",
+	http.StatusNotFound:            "/problems/not-found",
+	http.StatusMethodNotAllowed:    "/problems/method-not-allowed",
+	http.StatusConflict:            "/problems/conflict",
+	http.StatusUnprocessableEntity: "/problems/unprocessable",
+	http.StatusInternalServerError: "/problems/internal",
+	http.StatusServiceUnavailable:  "/problems/unavailable",
+}
+
+// validationProblemType is used for 400s listing invalid fields
+const validationProblemType = "/problems/validation"
+
+// newProblem converts an ErrorResponse sent with status into a Problem
+func newProblem(status int, resp ErrorResponse, instance string) Problem {
+	p := Problem{
+		Type:     problemTypes[status],
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   resp.Error,
+		Instance: instance,
+		Errors:   resp.Fields,
+		ErrorID:  resp.ErrorID,
+	}
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if status == http.StatusBadRequest && len(resp.Fields) > 0 {
+		p.Type = validationProblemType
+	}
+	return p
+}
+
+// ProblemJSONMiddleware renders error responses as application/problem+json
+// (RFC 7807) when always is set or the client asks for it in Accept. Only
+// error responses are buffered; everything else passes straight through.
+func ProblemJSONMiddleware(always bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !always {
+			// Errors are rendered by Accept, so caches must key them on
+			// it, including errors from handlers that never look at it
+			addVary(w.Header(), "Accept")
+		}
+		if !always && !acceptsProblemJSON(r.Header.Get("Accept")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pw := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		if !pw.buffering {
+			return
+		}
+
+		var resp ErrorResponse
+		if json.Unmarshal(pw.body.Bytes(), &resp) != nil || resp.Error == "" {
+			// Not an ErrorResponse, e.g. a batch summary; send it unchanged
+			w.WriteHeader(pw.status)
+			w.Write(pw.body.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(pw.status)
+		json.NewEncoder(w).Encode(newProblem(pw.status, resp, r.URL.RequestURI()))
+	})
+}
+
+// acceptsProblemJSON reports whether an Accept header lists application/problem+json
+func acceptsProblemJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/problem+json" {
+			return true
+		}
+	}
+	return false
+}
+
+// problemWriter buffers JSON error responses so they can be rewritten
+type problemWriter struct {
+	http.ResponseWriter
+	status    int
+	buffering bool
+	body      bytes.Buffer
+}
+
+// WriteHeader starts buffering for uncompressed JSON errors
+func (pw *problemWriter) WriteHeader(status int) {
+	h := pw.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if status >= 400 && mediaType == "application/json" && h.Get("Content-Encoding") == "" {
+		pw.status = status
+		pw.buffering = true
+		return
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+// Write buffers error bodies and passes everything else through
+func (pw *problemWriter) Write(p []byte) (int, error) {
+	if pw.buffering {
+		return pw.body.Write(p)
+	}
+	return pw.ResponseWriter.Write(p)
+}
+
+// Response formats a client can choose with Accept
+const (
+	formatJSON = "application/json"
+	formatXML  = "application/xml"
+)
+
+// ResponseFormatMiddleware renders JSON responses in the format the Accept
+// header asks for, JSON or XML, falling back to defaultType when Accept is
+// absent or accepts anything. Handlers keep writing JSON; only responses
+// that are converted are buffered.
+func ResponseFormatMiddleware(defaultType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w.Header(), "Accept")
+		if negotiateFormat(r.Header.Get("Accept"), defaultType) != formatXML {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fw := &formatWriter{ResponseWriter: w}
+		next.ServeHTTP(fw, r)
+		if !fw.buffering {
+			return
+		}
+
+		var v interface{}
+		dec := json.NewDecoder(&fw.body)
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			logger.Error("failed to convert response to XML", "error", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		var out bytes.Buffer
+		out.WriteString(xml.Header)
+		writeXMLElement(&out, "response", v)
+		out.WriteByte('\n')
+		w.Header().Set("Content-Type", formatXML)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(fw.status)
+		w.Write(out.Bytes())
+	})
+}
+
+// addVary adds field to the Vary header unless it is listed already, as
+// it is when both a middleware and the handler depend on it
+func addVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// negotiateFormat picks the response format from an Accept header: the
+// first of JSON or XML it lists, or def when it accepts anything or neither
+func negotiateFormat(accept, def string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case formatJSON, "application/problem+json", mediaTypeBookV1, mediaTypeBookV2:
+			return formatJSON
+		case formatXML, "text/xml":
+			return formatXML
+		case "*/*", "application/*":
+			return def
+		}
+	}
+	return def
+}
+
+// formatWriter buffers uncompressed JSON responses for conversion
+type formatWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buffering   bool
+	body        bytes.Buffer
+}
+
+// WriteHeader starts buffering for JSON bodies
+func (fw *formatWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.wroteHeader = true
+	h := fw.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if mediaType == formatJSON && h.Get("Content-Encoding") == "" {
+		fw.status = status
+		fw.buffering = true
+		return
+	}
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+// Write buffers JSON bodies and passes everything else through
+func (fw *formatWriter) Write(p []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if fw.buffering {
+		return fw.body.Write(p)
+	}
+	return fw.ResponseWriter.Write(p)
+}
+
+// writeXMLElement writes v, decoded from JSON, as an element called name.
+// Objects become child elements in key order and arrays repeated <item>
+// elements. Keys that are not valid XML names, such as author names, are
+// written as <entry key="...">.
+func writeXMLElement(buf *bytes.Buffer, name string, v interface{}) {
+	open, end := name, name
+	if !isXMLName(name) {
+		var key bytes.Buffer
+		xml.EscapeText(&key, []byte(name))
+		open, end = `entry key="`+key.String()+`"`, "entry"
+	}
+	buf.WriteString("<" + open + ">")
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeXMLElement(buf, key, v[key])
+		}
+	case []interface{}:
+		for _, item := range v {
+			writeXMLElement(buf, "item", item)
+		}
+	case nil:
+	default:
+		xml.EscapeText(buf, []byte(fmt.Sprint(v)))
+	}
+	buf.WriteString("</" + end + ">")
+}
+
+// isXMLName reports whether name can be used as an element name as is
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_' || unicode.IsLetter(c):
+		case i > 0 && (c == '-' || c == '.' || unicode.IsDigit(c)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Defaults for response compression
+const (
+	defaultGzipMinSize = 1024
+	defaultGzipTypes   = "application/json,text/csv,application/x-ndjson,application/xml"
+)
+
+// GzipMiddleware gzips responses for clients that accept it, but only when
+// the Content-Type is one of types and the body is at least minSize bytes;
+// tiny or already-compressed payloads are not worth the CPU. At most
+// minSize bytes are held back to learn which; the rest is streamed, and a
+// response the headers rule out is passed on as soon as they are written.
+// Partial content is sent as is, since its byte range refers to the
+// uncompressed body, and the ETag of a compressed body is made weak, so
+// If-Range never resumes it from uncompressed bytes.
+func GzipMiddleware(minSize int, types []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		allowed[strings.ToLower(t)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipWriter{ResponseWriter: w, minSize: minSize, allowed: allowed}
+		next.ServeHTTP(gw, r)
+		gw.finish()
+	})
+}
+
+// gzipWriter decides per response whether to compress. The status and up
+// to minSize bytes of body are held back until the size is known to be
+// enough, then the body is streamed through gzip; otherwise everything is
+// passed on unchanged.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	allowed map[string]bool
+
+	status  int
+	pending []byte
+	passed  bool
+	gz      *gzip.Writer
+}
+
+// WriteHeader records the status, passing the response on at once when
+// its headers rule compression out
+func (g *gzipWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if g.status != 0 {
+		return
+	}
+	g.status = status
+	mediaType, _, _ := mime.ParseMediaType(g.Header().Get("Content-Type"))
+	if !g.allowed[mediaType] || g.Header().Get("Content-Encoding") != "" ||
+		status == http.StatusPartialContent || status == http.StatusNoContent || status == http.StatusNotModified {
+		g.pass()
+	}
+}
+
+// Write holds the body back until minSize bytes decide on compression
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.passed:
+		return g.ResponseWriter.Write(p)
+	}
+	g.pending = append(g.pending, p...)
+	if len(g.pending) >= g.minSize {
+		if err := g.compress(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what was written so far. A response still undecided is
+// compressed, since a handler flushing its body expects more to follow.
+func (g *gzipWriter) Flush() {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.passed && g.gz == nil {
+		g.compress()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// pass sends the status and any held-back body uncompressed
+func (g *gzipWriter) pass() error {
+	g.passed = true
+	g.ResponseWriter.WriteHeader(g.status)
+	pending := g.pending
+	g.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err := g.ResponseWriter.Write(pending)
+	return err
+}
+
+// compress sends the status with gzip headers and starts the compressed
+// body with what was held back
+func (g *gzipWriter) compress() error {
+	h := g.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	pending := g.pending
+	g.pending = nil
+	_, err := g.gz.Write(pending)
+	return err
+}
+
+// finish completes the response once the handler returns: a body shorter
+// than minSize goes out uncompressed, a compressed one is terminated
+func (g *gzipWriter) finish() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case g.status != 0 && !g.passed:
+		g.pass()
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(coding, "gzip") && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// CORSMiddleware allows cross-origin requests from the given origins ("*"
+// allows any) and answers preflight requests. maxAge tells browsers how long
+// to cache a preflight; zero disables caching.
+func CORSMiddleware(origins []string, maxAge time.Duration, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	maxAgeSeconds := strconv.Itoa(int(maxAge / time.Second))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", reqHeaders)
+			}
+			h.Set("Access-Control-Max-Age", maxAgeSeconds)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RepoInfoHandler serves GET /api/admin/repo-info for repositories that
+// can describe themselves, redacting credentials from their location
+func RepoInfoHandler(repo BookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		provider, ok := repo.(interface{ Info() RepositoryInfo })
+		if !ok {
+			writeError(w, http.StatusNotImplemented, "repository does not report its internals")
+			return
+		}
+		info := provider.Info()
+		info.Location = redactDSN(info.Location)
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// readOnlyRetryAfter is the Retry-After value, in seconds, sent while read-only
+const readOnlyRetryAfter = "120"
+
+// ReadOnlyMode blocks mutating requests while enabled, leaving reads available
+type ReadOnlyMode struct {
+	enabled atomic.Bool
+}
+
+// Enabled reports whether read-only mode is on
+func (m *ReadOnlyMode) Enabled() bool {
+	return m.enabled.Load()
+}
+
+// Set turns read-only mode on or off
+func (m *ReadOnlyMode) Set(enabled bool) {
+	m.enabled.Store(enabled)
+}
+
+// Middleware answers mutating requests with 503 while read-only mode is on.
+// Admin endpoints stay reachable so the mode can be switched off again,
+// and import dry runs, which store nothing, are still served.
+func (m *ReadOnlyMode) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Enabled() && isMutating(r.Method) && !strings.HasPrefix(r.URL.Path, "/api/admin/") && !isDryRunImport(r) {
+			w.Header().Set("Retry-After", readOnlyRetryAfter)
+			writeError(w, http.StatusServiceUnavailable, "server is in read-only mode")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleToggle serves /api/admin/read-only: GET reports the mode, PUT sets it
+func (m *ReadOnlyMode) HandleToggle(w http.ResponseWriter, r *http.Request) {
+	var state struct {
+		ReadOnly bool `json:"readOnly"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		m.Set(state.ReadOnly)
+		logger.Info("read-only mode changed", "read_only", state.ReadOnly)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+		return
+	}
+	state.ReadOnly = m.Enabled()
+	writeJSON(w, http.StatusOK, state)
+}
+
+// isMutating reports whether an HTTP method changes server state
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,343 @@
+package bookapi
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISchemas builds JSON schemas from Go types, collecting named
+// structs as components so the document follows the wire types
+type openAPISchemas map[string]interface{}
+
+// of returns the schema for t, referencing named structs by component
+func (s openAPISchemas) of(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // reserve the name for recursive types
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object describes the JSON-visible fields of struct type t
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = s.of(field.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// openAPIOperation describes one method of a path
+type openAPIOperation struct {
+	summary  string
+	params   []map[string]interface{}
+	body     interface{} // request body example value, nil for none
+	status   int
+	response interface{} // response example value, nil for none
+	errors   []int
+}
+
+// queryParam and pathParam describe operation parameters
+func queryParam(name, typ, description string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "query", "description": description, "schema": map[string]interface{}{"type": typ}}
+}
+
+func pathParam(name, description string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "path", "required": true, "description": description, "schema": map[string]interface{}{"type": "string"}}
+}
+
+// build renders the operation, deriving schemas from its example values
+func (op openAPIOperation) build(schemas openAPISchemas) map[string]interface{} {
+	content := func(v interface{}) map[string]interface{} {
+		return map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.of(reflect.TypeOf(v))}}
+	}
+	success := map[string]interface{}{"description": http.StatusText(op.status)}
+	if op.response != nil {
+		success["content"] = content(op.response)
+	}
+	responses := map[string]interface{}{strconv.Itoa(op.status): success}
+	for _, code := range op.errors {
+		responses[strconv.Itoa(code)] = map[string]interface{}{"$ref": "#/components/responses/Error"}
+	}
+
+	out := map[string]interface{}{"summary": op.summary, "responses": responses}
+	if len(op.params) > 0 {
+		out["parameters"] = op.params
+	}
+	if op.body != nil {
+		out["requestBody"] = map[string]interface{}{"required": true, "content": content(op.body)}
+	}
+	return out
+}
+
+// buildOpenAPISpec describes every endpoint served by NewRouter and the admin routes
+func buildOpenAPISpec() map[string]interface{} {
+	schemas := openAPISchemas{}
+	idParam := pathParam("id", "book ID")
+	upsertHeader := map[string]interface{}{"name": "X-Upsert", "in": "header", "description": "create the book when the ID is unknown (201) instead of answering 404", "schema": map[string]interface{}{"type": "boolean"}}
+	versionHeader := map[string]interface{}{"name": "Accept", "in": "header", "description": mediaTypeBookV1 + " for the original book fields only, " + mediaTypeBookV2 + " (the default) for all of them", "schema": map[string]interface{}{"type": "string"}}
+	paths := map[string]map[string]openAPIOperation{
+		"/api/books": {
+			"get": {summary: "List books", params: []map[string]interface{}{
+				queryParam("view", "string", "full (default) or summary"),
+				queryParam("sort", "string", "id, title, author or year, prefixed with - for descending"),
+				queryParam("year", "integer", "only books published in exactly this year"),
+				queryParam("idFrom", "integer", "only books with a numeric ID of at least this, together with idTo"),
+				queryParam("idTo", "integer", "only books with a numeric ID of at most this, together with idFrom"),
+				versionHeader,
+				{"name": "If-None-Match", "in": "header", "description": "ETag of a cached list; answered with 304 and no body while the list is unchanged", "schema": map[string]interface{}{"type": "string"}},
+			}, status: http.StatusOK, response: []*Book{}, errors: []int{400, 406}},
+			"post": {summary: "Create a book", params: []map[string]interface{}{
+				{"name": "Idempotency-Key", "in": "header", "description": "replays the first response for retries with the same key", "schema": map[string]interface{}{"type": "string"}},
+			}, body: Book{}, status: http.StatusCreated, response: Book{}, errors: []int{400, 403, 422}},
+		},
+		"/api/books/{id}": {
+			"get": {summary: "Get a book; with withHistory=true a BookWithHistory instead", params: []map[string]interface{}{
+				idParam, versionHeader,
+				queryParam("withHistory", "boolean", "true to return the book, or its tombstone once deleted, with its audit history (requires --audit-log)"),
+			}, status: http.StatusOK, response: Book{}, errors: []int{400, 404, 406, 501}},
+			"put":    {summary: "Replace a book", params: []map[string]interface{}{idParam}, body: Book{}, status: http.StatusOK, response: Book{}, errors: []int{400, 404}},
+			"patch":  {summary: "Change some fields of a book, or create it with X-Upsert: true", params: []map[string]interface{}{idParam, upsertHeader}, body: Book{}, status: http.StatusOK, response: Book{}, errors: []int{400, 404, 422}},
+			"delete": {summary: "Delete a book", params: []map[string]interface{}{idParam}, status: http.StatusOK, response: map[string]string{}, errors: []int{404}},
+		},
+		"/api/books/{id}/increment": {
+			"post": {summary: "Atomically add delta to a numeric field (publishedYear)", params: []map[string]interface{}{idParam}, body: incrementRequest{}, status: http.StatusOK, response: incrementResponse{}, errors: []int{400, 404}},
+		},
+		"/api/books/{id}/touch": {
+			"post": {summary: "Bump updatedAt without changing anything else", params: []map[string]interface{}{idParam}, status: http.StatusOK, response: Book{}, errors: []int{404}},
+		},
+		"/api/books/{id}/pop": {
+			"post": {summary: "Delete a book and return it in one atomic step; of concurrent pops only one gets the book", params: []map[string]interface{}{idParam}, status: http.StatusOK, response: Book{}, errors: []int{404}},
+		},
+		"/api/books/{id}/reassign": {
+			"post": {summary: "Move a book to a new ID", params: []map[string]interface{}{idParam}, body: struct {
+				NewID string `json:"newId"`
+			}{}, status: http.StatusOK, response: Book{}, errors: []int{400, 404, 409}},
+		},
+		"/api/books/search": {
+			"get": {summary: "Search books; past --search-summary-threshold matches, summaries flagged with X-Result-Summarized", params: []map[string]interface{}{
+				queryParam("author", "string", "author substring"),
+				queryParam("title", "string", "title substring; together with author only books matching both are returned"),
+				queryParam("description", "string", "space-separated words that must all occur in the description"),
+				queryParam("isbnPrefix", "string", "leading ISBN digits; hyphens and spaces are ignored"),
+				queryParam("genre", "string", "exact genre, ignoring case"),
+				queryParam("fuzzy", "boolean", "match title or author (only one of them) within a few typos, closest first"),
+			}, status: http.StatusOK, response: []*Book{}, errors: []int{400, 404, 503}},
+		},
+		"/api/books/validate": {
+			"post": {summary: "Validate a book without storing it", body: Book{}, status: http.StatusOK, response: validationResult{}, errors: []int{400, 422}},
+		},
+		"/api/books/extremes": {
+			"get": {summary: "Oldest and newest books", status: http.StatusOK, response: map[string]*Book{}},
+		},
+		"/api/books/batch": {
+			"post": {summary: "Create several books", body: []*Book{}, status: http.StatusOK, response: BatchSummary{}, errors: []int{400, 403, 413}},
+			"delete": {summary: "Delete several books", body: struct {
+				IDs []string `json:"ids"`
+			}{}, status: http.StatusOK, response: BulkDeleteSummary{}, errors: []int{400, 413}},
+		},
+		"/api/books/import": {
+			"post": {summary: "Stream a JSON array of books, or CSV with a header row sent as text/csv, into the catalog", params: []map[string]interface{}{
+				queryParam("delimiter", "string", "CSV field separator, a single character; default ,"),
+				queryParam("dryRun", "boolean", "true to check every book as a create would, against the stored books and the earlier books of the import, and report what would be created without storing anything; allowed in read-only mode"),
+			}, body: []*Book{}, status: http.StatusOK, response: BatchSummary{}, errors: []int{400}},
+		},
+		"/api/books/import-url": {
+			"post": {summary: "Fetch a JSON array of books from an http or https URL and import it", body: importURLRequest{}, status: http.StatusOK, response: BatchSummary{}, errors: []int{400, 403, 502, 504}},
+		},
+		"/api/books/merge": {
+			"post": {summary: "Merge two books", body: struct {
+				Keep   string `json:"keep"`
+				Remove string `json:"remove"`
+			}{}, status: http.StatusOK, response: Book{}, errors: []int{400, 404}},
+		},
+		"/api/books/lookup": {
+			"post": {summary: "Fetch several books by ID, optionally projected to some fields", body: struct {
+				IDs    []string `json:"ids"`
+				Fields []string `json:"fields"`
+			}{}, status: http.StatusOK, response: lookupResponse{}, errors: []int{400}},
+		},
+		"/api/books/categorize": {
+			"post": {summary: "Set the genre of several books", body: struct {
+				IDs           []string `json:"ids"`
+				Genre         string   `json:"genre"`
+				Transactional bool     `json:"transactional"`
+			}{}, status: http.StatusOK, response: BulkUpdateSummary{}, errors: []int{400, 404}},
+		},
+		"/api/books/genre-by-author": {
+			"post": {summary: "Set the genre of every book by an author", body: genreByAuthorRequest{}, status: http.StatusOK, response: map[string]int{}, errors: []int{400}},
+		},
+		"/api/books/duplicates": {
+			"get": {summary: "Group likely duplicates", params: []map[string]interface{}{
+				queryParam("by", "string", "isbn or title-author (default)"),
+				queryParam("offset", "integer", "number of clusters to skip"),
+				queryParam("limit", "integer", "number of clusters, at most 100"),
+			}, status: http.StatusOK, response: []DuplicateCluster{}, errors: []int{400}},
+		},
+		"/api/books/incomplete": {
+			"get": {summary: "Books missing metadata", params: []map[string]interface{}{
+				queryParam("missing", "string", "comma-separated subset of isbn, year and description"),
+			}, status: http.StatusOK, response: []*Book{}, errors: []int{400}},
+		},
+		"/api/books/quality": {
+			"get": {summary: "Catalog completeness score (0-100) over isbn, year, description and genre, with a per-field breakdown", status: http.StatusOK, response: QualityReport{}},
+		},
+		"/api/books/authors": {
+			"get": {summary: "Authors with the most books", params: []map[string]interface{}{
+				queryParam("limit", "integer", "number of authors, default 10, at most 100"),
+			}, status: http.StatusOK, response: []AuthorCount{}, errors: []int{400}},
+		},
+		"/api/books/isbns": {
+			"get": {summary: "Distinct normalized ISBNs in the catalog", params: []map[string]interface{}{
+				queryParam("withIds", "boolean", "list {isbn, id} pairs, one per book, instead of plain ISBNs"),
+			}, status: http.StatusOK, response: []string{}, errors: []int{400}},
+		},
+		"/api/books/export": {
+			"get": {summary: "Download the catalog as a ZIP with one CSV per author, or as one CSV", params: []map[string]interface{}{
+				queryParam("format", "string", "zip or csv"),
+				queryParam("delimiter", "string", "CSV field separator, a single character; default ,"),
+				{"name": "Range", "in": "header", "description": "a byte range such as bytes=1024- to resume a download; answered with 206", "schema": map[string]interface{}{"type": "string"}},
+				{"name": "If-Range", "in": "header", "description": "ETag of the interrupted download; the full export is sent if it has changed since", "schema": map[string]interface{}{"type": "string"}},
+			}, status: http.StatusOK, errors: []int{400, 416}},
+		},
+		"/api/books/by-author": {
+			"get": {summary: "Books grouped by author, paged over authors", params: []map[string]interface{}{
+				queryParam("offset", "integer", "number of authors to skip"),
+				queryParam("limit", "integer", "number of authors, at most 100"),
+				queryParam("perAuthor", "integer", "maximum books per author, 0 for all"),
+			}, status: http.StatusOK, response: []AuthorGroup{}, errors: []int{400}},
+		},
+		"/api/books/changes": {
+			"get": {summary: "Changes since a token, oldest first; 410 when the token is too old to resume from", params: []map[string]interface{}{
+				queryParam("since", "string", "token from a previous response; omit to get the current token"),
+				queryParam("limit", "integer", "number of changes, default and at most 100"),
+			}, status: http.StatusOK, response: ChangeFeed{}, errors: []int{400, 410}},
+		},
+		"/api/books/popular": {
+			"get": {summary: "Most viewed books since the server started", params: []map[string]interface{}{
+				queryParam("limit", "integer", "number of books, default 10, at most 100"),
+			}, status: http.StatusOK, response: []BookViews{}, errors: []int{400}},
+		},
+		"/api/books/recent": {
+			"get": {summary: "Most recently created books", params: []map[string]interface{}{
+				queryParam("limit", "integer", "number of books, default 10, at most 100"),
+			}, status: http.StatusOK, response: []*Book{}, errors: []int{400}},
+		},
+		"/api/books/by-decade": {
+			"get": {summary: "Book counts per published decade", params: []map[string]interface{}{
+				queryParam("includeEmpty", "boolean", "include zero-count decades between the first and last"),
+			}, status: http.StatusOK, response: []DecadeCount{}, errors: []int{400}},
+		},
+		"/api/books/index": {
+			"get": {summary: "Book counts per initial letter of the title or author, with # for non-letters", params: []map[string]interface{}{
+				queryParam("field", "string", "title (default) or author"),
+				queryParam("ids", "boolean", "also list the IDs in each bucket"),
+			}, status: http.StatusOK, response: map[string]InitialCount{}, errors: []int{400}},
+		},
+		"/api/books/validate-isbn/{isbn}": {
+			"get": {summary: "Check an ISBN-10/13 checksum without storing anything", params: []map[string]interface{}{pathParam("isbn", "ISBN, hyphens allowed")}, status: http.StatusOK, response: isbnValidation{}},
+		},
+		"/api/books/resolve/{key}": {
+			"get": {summary: "Look a book up by ID or ISBN", params: []map[string]interface{}{pathParam("key", "book ID or ISBN")}, status: http.StatusOK, response: struct {
+				MatchedBy string `json:"matchedBy"`
+				Book      *Book  `json:"book"`
+			}{}, errors: []int{404}},
+		},
+		"/healthz": {
+			"get": {summary: "Liveness check with the repository backend", status: http.StatusOK, response: healthStatus{}},
+		},
+		"/api/version": {
+			"get": {summary: "Build and runtime version", status: http.StatusOK, response: VersionInfo{}},
+		},
+		"/api/admin/read-only": {
+			"get": {summary: "Report read-only mode", status: http.StatusOK, response: struct {
+				ReadOnly bool `json:"readOnly"`
+			}{}},
+			"put": {summary: "Set read-only mode", body: struct {
+				ReadOnly bool `json:"readOnly"`
+			}{}, status: http.StatusOK, response: struct {
+				ReadOnly bool `json:"readOnly"`
+			}{}, errors: []int{400}},
+		},
+		"/api/admin/repo-info": {
+			"get": {summary: "Describe the repository internals", status: http.StatusOK, response: RepositoryInfo{}, errors: []int{501}},
+		},
+	}
+
+	built := make(map[string]interface{}, len(paths))
+	for path, ops := range paths {
+		item := make(map[string]interface{}, len(ops))
+		for method, op := range ops {
+			item[method] = op.build(schemas)
+		}
+		built[path] = item
+	}
+	errorSchema := schemas.of(reflect.TypeOf(ErrorResponse{}))
+	if book, ok := schemas["Book"].(map[string]interface{}); ok {
+		book["required"] = []string{"title", "author"}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Book API",
+			"version": "1.0.0",
+		},
+		"paths": built,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+				},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler serves GET /openapi.json
+func OpenAPIHandler() http.HandlerFunc {
+	spec := buildOpenAPISpec()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, spec)
+	}
+}
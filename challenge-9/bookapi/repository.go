@@ -0,0 +1,1179 @@
+package bookapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// InMemoryBookRepository implements BookRepository using in-memory storage
+type InMemoryBookRepository struct {
+	books  map[string]*Book
+	nextID int
+	mu     sync.RWMutex
+
+	// authorKeys maps book IDs to their normalized author when
+	// author normalization is enabled
+	normalizeAuthors bool
+	authorKeys       map[string]string
+
+	// isbnIndex maps normalized ISBNs to the IDs of the books carrying them
+	isbnIndex map[string]map[string]bool
+	// authorCounts maps the authorGroupKey of each listed author to their
+	// number of books
+	authorCounts map[string]*authorCount
+	// genreIndex maps lower-cased genres to the IDs of their books
+	genreIndex map[string]map[string]bool
+
+	// clock stamps CreatedAt and UpdatedAt
+	clock Clock
+
+	// maxBooks limits the catalog size (0 means unlimited); pending counts
+	// books of in-flight batches that have IDs reserved but are not stored yet
+	maxBooks int
+	pending  int
+
+	// capacity is the expected number of books, used to pre-size the maps
+	capacity int
+
+	// uniqueISBNs rejects writes that would give two books the same ISBN;
+	// reservedISBNs holds the normalized ISBNs of in-flight batches, which
+	// count as taken until their books are stored
+	uniqueISBNs   bool
+	reservedISBNs map[string]bool
+
+	// maxDescription caps descriptions in characters (0 means no cap)
+	maxDescription int
+
+	// changes records the most recent writes for the change feed
+	changes       *changeLog
+	changeLogSize int
+
+	// journal, while set, records the state each write replaces so the
+	// writes can be undone; see FileBookRepository.logged
+	journal *undoJournal
+}
+
+// undoJournal is the state replaced by a sequence of writes: the ID
+// counter before them and each overwritten book in order, nil for a book
+// that did not exist
+type undoJournal struct {
+	nextID  int
+	entries []undoEntry
+}
+
+type undoEntry struct {
+	id  string
+	old *Book
+}
+
+// Clock is the source of the current time, replaceable in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock reads the system clock
+type realClock struct{}
+
+// Now implements Clock
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RepositoryOption configures an InMemoryBookRepository
+type RepositoryOption func(*InMemoryBookRepository)
+
+// WithAuthorNormalization makes author searches ignore punctuation and
+// spacing, so "J.R.R. Tolkien" and "JRR Tolkien" match each other.
+// Authors are still returned as entered.
+func WithAuthorNormalization() RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		r.normalizeAuthors = true
+	}
+}
+
+// WithClock sets the clock used to stamp CreatedAt and UpdatedAt
+func WithClock(c Clock) RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		r.clock = c
+	}
+}
+
+// WithCapacity pre-sizes the store and its indexes for about n books,
+// avoiding rehashing during bulk loads. It is only a hint; the repository
+// still grows beyond n.
+func WithCapacity(n int) RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		if n > 0 {
+			r.capacity = n
+		}
+	}
+}
+
+// WithMaxBooks makes creates fail with ErrCapacityExceeded once n books are
+// stored; 0 means unlimited
+func WithMaxBooks(n int) RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		r.maxBooks = n
+	}
+}
+
+// WithMaxDescriptionLength makes creates and updates fail with a
+// *ValidationError when the description is longer than n characters; 0
+// means no cap. The repository checks this itself, so callers that skip
+// the service's validation cannot store longer descriptions.
+func WithMaxDescriptionLength(n int) RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		r.maxDescription = n
+	}
+}
+
+// WithUniqueISBNs makes creates and updates fail with ErrBookExists when
+// another book already has the same normalized ISBN. Books without an ISBN
+// are not affected.
+func WithUniqueISBNs() RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		r.uniqueISBNs = true
+	}
+}
+
+// WithChangeLogSize sets how many recent changes are kept for the change
+// feed; clients further behind than that must resync
+func WithChangeLogSize(n int) RepositoryOption {
+	return func(r *InMemoryBookRepository) {
+		if n > 0 {
+			r.changeLogSize = n
+		}
+	}
+}
+
+// NewInMemoryBookRepository creates a new in-memory book repository
+func NewInMemoryBookRepository(opts ...RepositoryOption) *InMemoryBookRepository {
+	r := &InMemoryBookRepository{clock: realClock{}, changeLogSize: defaultChangeLogSize}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.reset()
+	return r
+}
+
+// reset empties the store and its indexes, sizing them for the capacity
+// hint. The caller must hold r.mu.
+func (r *InMemoryBookRepository) reset() {
+	r.books = make(map[string]*Book, r.capacity)
+	r.authorKeys = make(map[string]string)
+	if r.normalizeAuthors {
+		r.authorKeys = make(map[string]string, r.capacity)
+	}
+	r.isbnIndex = make(map[string]map[string]bool, r.capacity)
+	r.reservedISBNs = make(map[string]bool)
+	r.authorCounts = make(map[string]*authorCount)
+	r.genreIndex = make(map[string]map[string]bool)
+	// Tokens from before a reset describe another store, so they expire
+	r.changes = newChangeLog(r.changeLogSize)
+}
+
+// put stores a copy of book and updates the indexes. The caller must hold r.mu.
+func (r *InMemoryBookRepository) put(book *Book) {
+	if r.journal != nil {
+		r.journal.entries = append(r.journal.entries, undoEntry{id: book.ID, old: r.books[book.ID]})
+	}
+	change := ChangeCreated
+	if old, ok := r.books[book.ID]; ok {
+		r.unindex(old)
+		change = ChangeUpdated
+	}
+	stored := copyBook(book)
+	r.books[stored.ID] = stored
+	r.changes.add(change, stored.ID, copyBook(stored))
+	if r.normalizeAuthors {
+		r.authorKeys[stored.ID] = authorKey(stored.Author)
+	}
+	if isbn := normalizeISBN(stored.ISBN); isbn != "" {
+		if r.isbnIndex[isbn] == nil {
+			r.isbnIndex[isbn] = make(map[string]bool)
+		}
+		r.isbnIndex[isbn][stored.ID] = true
+	}
+	r.countAuthors(stored.Author, 1)
+	if genre := genreKey(stored.Genre); genre != "" {
+		if r.genreIndex[genre] == nil {
+			r.genreIndex[genre] = make(map[string]bool)
+		}
+		r.genreIndex[genre][stored.ID] = true
+	}
+}
+
+// checkISBNFree reports whether isbn may be stored on the book with ID
+// self: with unique ISBNs, no other book may carry it, nor a batch have
+// reserved it. A book keeping its own ISBN passes. The caller must hold r.mu.
+func (r *InMemoryBookRepository) checkISBNFree(isbn, self string) error {
+	key := normalizeISBN(isbn)
+	if !r.uniqueISBNs || key == "" {
+		return nil
+	}
+	if r.reservedISBNs[key] {
+		return fmt.Errorf("%w: ISBN %s is being stored by a batch", ErrBookExists, isbn)
+	}
+	for id := range r.isbnIndex[key] {
+		if id != self {
+			return fmt.Errorf("%w: ISBN %s is already used by book %s", ErrBookExists, isbn, id)
+		}
+	}
+	return nil
+}
+
+// checkDescription rejects a description longer than maxDescription
+func (r *InMemoryBookRepository) checkDescription(book *Book) error {
+	if r.maxDescription <= 0 {
+		return nil
+	}
+	if n := utf8.RuneCountInString(book.Description); n > r.maxDescription {
+		verr := &ValidationError{}
+		verr.add("description", fmt.Sprintf("is %d characters, at most %d are allowed", n, r.maxDescription))
+		return verr
+	}
+	return nil
+}
+
+// remove deletes a book and its index entries. The caller must hold r.mu.
+func (r *InMemoryBookRepository) remove(id string) {
+	if old, ok := r.books[id]; ok {
+		if r.journal != nil {
+			r.journal.entries = append(r.journal.entries, undoEntry{id: id, old: old})
+		}
+		r.unindex(old)
+		r.changes.add(ChangeDeleted, id, nil)
+	}
+	delete(r.books, id)
+}
+
+// authorCount is the number of books of one author along with how many
+// of them spell the name each way
+type authorCount struct {
+	n     int
+	names map[string]int
+}
+
+// name is the spelling most of the author's books use, ties going to the
+// first in string order
+func (c *authorCount) name() string {
+	var name string
+	for spelling, n := range c.names {
+		if n > c.names[name] || n == c.names[name] && spelling < name {
+			name = spelling
+		}
+	}
+	return name
+}
+
+// countAuthors adds delta to the count of each author listed in author,
+// dropping authors left without books. The caller must hold r.mu.
+func (r *InMemoryBookRepository) countAuthors(author string, delta int) {
+	for _, name := range splitAuthors(author) {
+		key := authorGroupKey(name)
+		count, ok := r.authorCounts[key]
+		if !ok {
+			count = &authorCount{names: make(map[string]int)}
+			r.authorCounts[key] = count
+		}
+		count.n += delta
+		if count.names[name] += delta; count.names[name] <= 0 {
+			delete(count.names, name)
+		}
+		if count.n <= 0 {
+			delete(r.authorCounts, key)
+		}
+	}
+}
+
+// unindex drops the index entries of a stored book. The caller must hold r.mu.
+func (r *InMemoryBookRepository) unindex(book *Book) {
+	delete(r.authorKeys, book.ID)
+	r.countAuthors(book.Author, -1)
+	if isbn := normalizeISBN(book.ISBN); isbn != "" {
+		delete(r.isbnIndex[isbn], book.ID)
+		if len(r.isbnIndex[isbn]) == 0 {
+			delete(r.isbnIndex, isbn)
+		}
+	}
+	if genre := genreKey(book.Genre); genre != "" {
+		delete(r.genreIndex[genre], book.ID)
+		if len(r.genreIndex[genre]) == 0 {
+			delete(r.genreIndex, genre)
+		}
+	}
+}
+
+// Change feed event types
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// defaultChangeLogSize is the number of changes kept for the change feed
+// unless configured otherwise
+const defaultChangeLogSize = 1000
+
+// ChangeEvent is one write in the change feed. Book is the new state and
+// is omitted for deletes.
+type ChangeEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Book *Book  `json:"book,omitempty"`
+
+	seq uint64
+}
+
+// ChangeFeed is a page of changes. Next resumes after the last change
+// listed; HasMore reports that more changes are already waiting.
+type ChangeFeed struct {
+	Changes []ChangeEvent `json:"changes"`
+	Next    string        `json:"next"`
+	HasMore bool          `json:"hasMore"`
+}
+
+// changeLog keeps the most recent changes in sequence order, dropping the
+// oldest beyond its size. It is guarded by the repository lock.
+type changeLog struct {
+	// epoch tells tokens of this log apart from those of earlier logs,
+	// such as before a restart or a restore
+	epoch  string
+	seq    uint64
+	size   int
+	events []ChangeEvent
+}
+
+func newChangeLog(size int) *changeLog {
+	return &changeLog{epoch: strconv.FormatInt(time.Now().UnixNano(), 36), size: size}
+}
+
+// add appends a change with the next sequence number
+func (c *changeLog) add(change, id string, book *Book) {
+	c.seq++
+	if len(c.events) == c.size {
+		c.events = c.events[1:]
+	}
+	c.events = append(c.events, ChangeEvent{Type: change, ID: id, Book: book, seq: c.seq})
+}
+
+// token is the opaque resume point after sequence number seq
+func (c *changeLog) token(seq uint64) string {
+	return c.epoch + "." + strconv.FormatUint(seq, 10)
+}
+
+// since returns up to limit changes after token; an empty token starts
+// from the latest change, so only later writes are listed
+func (c *changeLog) since(token string, limit int) (*ChangeFeed, error) {
+	seq := c.seq
+	if token != "" {
+		epoch, value, ok := strings.Cut(token, ".")
+		n, err := strconv.ParseUint(value, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%w: malformed change token %q", ErrInvalidBook, token)
+		}
+		// The oldest change still kept must directly follow the token
+		oldest := c.seq + 1
+		if len(c.events) > 0 {
+			oldest = c.events[0].seq
+		}
+		if epoch != c.epoch || n > c.seq || n+1 < oldest {
+			return nil, fmt.Errorf("%w: fetch the full list and follow changes from a new token", ErrChangesExpired)
+		}
+		seq = n
+	}
+
+	start := len(c.events) - int(c.seq-seq)
+	pending := c.events[start:]
+	feed := &ChangeFeed{Changes: make([]ChangeEvent, 0, min(limit, len(pending)))}
+	if len(pending) > limit {
+		pending, feed.HasMore = pending[:limit], true
+	}
+	for _, event := range pending {
+		if event.Book != nil {
+			event.Book = copyBook(event.Book)
+		}
+		feed.Changes = append(feed.Changes, event)
+		seq = event.seq
+	}
+	feed.Next = c.token(seq)
+	return feed, nil
+}
+
+// genreKey is the genre index key: genres match ignoring case and
+// surrounding spaces
+func genreKey(genre string) string {
+	return strings.ToLower(strings.TrimSpace(genre))
+}
+
+// RepositoryInfo describes the internal state of a repository for debugging
+type RepositoryInfo struct {
+	Backend       string `json:"backend"`
+	NextID        int    `json:"nextId"`
+	Books         int    `json:"books"`
+	ISBNIndexSize int    `json:"isbnIndexSize"`
+	Location      string `json:"location,omitempty"`
+	// LastWrite is when a persistent backend last stored a change
+	LastWrite *time.Time `json:"lastWrite,omitempty"`
+}
+
+// Info reports the ID counter and the sizes of the store and its indexes
+func (r *InMemoryBookRepository) Info() RepositoryInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return RepositoryInfo{
+		Backend:       "memory",
+		NextID:        r.nextID,
+		Books:         len(r.books),
+		ISBNIndexSize: len(r.isbnIndex),
+	}
+}
+
+// ListVersion identifies the current contents of the repository: it
+// changes with every write and, through the change log epoch, on restart
+// or restore, without looking at the books themselves
+func (r *InMemoryBookRepository) ListVersion() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.changes.token(r.changes.seq)
+}
+
+// GetAll returns every stored book ordered by ID
+func (r *InMemoryBookRepository) GetAll() ([]*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	books := make([]*Book, 0, len(r.books))
+	for _, book := range r.books {
+		books = append(books, copyBook(book))
+	}
+	sortBooksByID(books)
+	return books, nil
+}
+
+// GetByID returns the book with the given ID
+func (r *InMemoryBookRepository) GetByID(id string) (*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	book, ok := r.books[id]
+	if !ok {
+		return nil, ErrBookNotFound
+	}
+	return copyBook(book), nil
+}
+
+// Exists reports for each ID whether a book is stored under it, checking
+// all of them under a single read lock
+func (r *InMemoryBookRepository) Exists(ids []string) map[string]bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	present := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		_, present[id] = r.books[id]
+	}
+	return present
+}
+
+// Create stores a new book and assigns it the next available ID
+func (r *InMemoryBookRepository) Create(book *Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkDescription(book); err != nil {
+		return err
+	}
+	if err := r.checkCapacity(1); err != nil {
+		return err
+	}
+	if err := r.checkISBNFree(book.ISBN, ""); err != nil {
+		return err
+	}
+	r.nextID++
+	book.ID = strconv.Itoa(r.nextID)
+	book.CreatedAt = r.clock.Now()
+	book.UpdatedAt = book.CreatedAt
+	r.put(book)
+	return nil
+}
+
+// CreateWithID stores book under its own ID, which must be unused. A
+// numeric ID beyond the counter advances it so later creates skip it.
+func (r *InMemoryBookRepository) CreateWithID(book *Book) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, taken := r.books[book.ID]; taken {
+		return fmt.Errorf("%w: %s", ErrBookExists, book.ID)
+	}
+	if err := r.checkDescription(book); err != nil {
+		return err
+	}
+	if err := r.checkCapacity(1); err != nil {
+		return err
+	}
+	if err := r.checkISBNFree(book.ISBN, book.ID); err != nil {
+		return err
+	}
+	book.CreatedAt = r.clock.Now()
+	book.UpdatedAt = book.CreatedAt
+	r.put(book)
+	if n, err := strconv.Atoi(book.ID); err == nil && n > r.nextID {
+		r.nextID = n
+	}
+	return nil
+}
+
+// CreateBatch stores several books under one contiguous block of IDs.
+// Other creates may interleave with the inserts but never share the block.
+// With unique ISBNs the batch is checked as a whole when the IDs are
+// reserved, against the stored books and against itself, and its ISBNs
+// stay reserved until each book is stored so no other write can take them.
+func (r *InMemoryBookRepository) CreateBatch(books []*Book) error {
+	ids, err := r.reserveIDs(books)
+	if err != nil {
+		return err
+	}
+	for i, book := range books {
+		book.ID = ids[i]
+		r.mu.Lock()
+		book.CreatedAt = r.clock.Now()
+		book.UpdatedAt = book.CreatedAt
+		if r.uniqueISBNs {
+			delete(r.reservedISBNs, normalizeISBN(book.ISBN))
+		}
+		r.put(book)
+		r.pending--
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// CheckCreates returns a function reporting the error Create would return
+// for each book passed to it, as if the books that passed before it had
+// been stored, but storing nothing. It checks the description cap, the
+// capacity and, with unique ISBNs, the stored books and the books before
+// it. Each check holds only the read lock, so a later Create can still
+// fail where the check passed.
+func (r *InMemoryBookRepository) CheckCreates() func(book *Book) error {
+	queued := 0
+	seen := make(map[string]bool)
+	return func(book *Book) error {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		if err := r.checkDescription(book); err != nil {
+			return err
+		}
+		if err := r.checkCapacity(queued + 1); err != nil {
+			return err
+		}
+		if err := r.checkISBNFree(book.ISBN, ""); err != nil {
+			return err
+		}
+		if key := normalizeISBN(book.ISBN); r.uniqueISBNs && key != "" {
+			if seen[key] {
+				return fmt.Errorf("%w: ISBN %s appears earlier in the batch", ErrBookExists, book.ISBN)
+			}
+			seen[key] = true
+		}
+		queued++
+		return nil
+	}
+}
+
+// reserveIDs atomically claims IDs and slots of capacity for books,
+// failing when they would exceed the book limit, reuse an ISBN or carry
+// an over-long description
+func (r *InMemoryBookRepository) reserveIDs(books []*Book) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(books)
+	for _, book := range books {
+		if err := r.checkDescription(book); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.checkCapacity(n); err != nil {
+		return nil, err
+	}
+	if r.uniqueISBNs {
+		seen := make(map[string]bool, n)
+		for _, book := range books {
+			if err := r.checkISBNFree(book.ISBN, ""); err != nil {
+				return nil, err
+			}
+			key := normalizeISBN(book.ISBN)
+			if key != "" && seen[key] {
+				return nil, fmt.Errorf("%w: ISBN %s appears twice in the batch", ErrBookExists, book.ISBN)
+			}
+			seen[key] = true
+		}
+		for key := range seen {
+			if key != "" {
+				r.reservedISBNs[key] = true
+			}
+		}
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		r.nextID++
+		ids[i] = strconv.Itoa(r.nextID)
+	}
+	r.pending += n
+	return ids, nil
+}
+
+// checkCapacity reports whether n more books fit under the limit.
+// r.mu must be held.
+func (r *InMemoryBookRepository) checkCapacity(n int) error {
+	if r.maxBooks > 0 && len(r.books)+r.pending+n > r.maxBooks {
+		return fmt.Errorf("%w: the catalog is limited to %d books", ErrCapacityExceeded, r.maxBooks)
+	}
+	return nil
+}
+
+// Update replaces the book with the given ID
+func (r *InMemoryBookRepository) Update(id string, book *Book) (BookChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.books[id]
+	if !ok {
+		return BookChange{}, ErrBookNotFound
+	}
+	if err := r.checkDescription(book); err != nil {
+		return BookChange{}, err
+	}
+	// The book's own current ISBN is excluded, so re-saving it succeeds
+	if err := r.checkISBNFree(book.ISBN, id); err != nil {
+		return BookChange{}, err
+	}
+	book.ID = id
+	book.CreatedAt = existing.CreatedAt
+	book.UpdatedAt = r.clock.Now()
+	r.put(book)
+	return BookChange{Before: copyBook(existing), After: copyBook(book)}, nil
+}
+
+// UpdateFunc applies update to a copy of the book id and stores the result,
+// all under the write lock, so concurrent read-modify-write updates never
+// lose one another. An error from update leaves the book unchanged. The
+// ID and CreatedAt cannot be changed this way.
+func (r *InMemoryBookRepository) UpdateFunc(id string, update func(book *Book) error) (BookChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.books[id]
+	if !ok {
+		return BookChange{}, ErrBookNotFound
+	}
+	book := copyBook(existing)
+	if err := update(book); err != nil {
+		return BookChange{}, err
+	}
+	if err := r.checkDescription(book); err != nil {
+		return BookChange{}, err
+	}
+	if err := r.checkISBNFree(book.ISBN, id); err != nil {
+		return BookChange{}, err
+	}
+	book.ID = id
+	book.CreatedAt = existing.CreatedAt
+	book.UpdatedAt = r.clock.Now()
+	r.put(book)
+	return BookChange{Before: copyBook(existing), After: copyBook(book)}, nil
+}
+
+// incrementFields are the numeric fields Increment may adjust, by JSON
+// name. They hold years and counts, so results below zero are rejected.
+var incrementFields = map[string]func(*Book) *int{
+	"publishedYear": func(b *Book) *int { return &b.PublishedYear },
+}
+
+// Increment adds delta to the numeric field of the book id under the write
+// lock, so concurrent increments never lose an update. An unknown field,
+// or a result below zero, is ErrInvalidBook.
+func (r *InMemoryBookRepository) Increment(id, field string, delta int) (BookChange, error) {
+	fieldOf, ok := incrementFields[field]
+	if !ok {
+		return BookChange{}, fmt.Errorf("%w: field %q cannot be incremented", ErrInvalidBook, field)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.books[id]
+	if !ok {
+		return BookChange{}, ErrBookNotFound
+	}
+	book := copyBook(existing)
+	value := fieldOf(book)
+	// Fields are never negative, so an overflow shows up as one too
+	if *value += delta; *value < 0 {
+		return BookChange{}, fmt.Errorf("%w: %s would become %d", ErrInvalidBook, field, *value)
+	}
+	book.UpdatedAt = r.clock.Now()
+	r.put(book)
+	return BookChange{Before: copyBook(existing), After: book}, nil
+}
+
+// Touch sets UpdatedAt of the book id to now without changing anything
+// else. The change feed reports it as an update.
+func (r *InMemoryBookRepository) Touch(id string) (BookChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.books[id]
+	if !ok {
+		return BookChange{}, ErrBookNotFound
+	}
+	book := copyBook(existing)
+	book.UpdatedAt = r.clock.Now()
+	r.put(book)
+	return BookChange{Before: copyBook(existing), After: book}, nil
+}
+
+// Pop removes the book id and returns it under one write lock, so of
+// several concurrent pops only one gets the book
+func (r *InMemoryBookRepository) Pop(id string) (*Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	book, ok := r.books[id]
+	if !ok {
+		return nil, ErrBookNotFound
+	}
+	r.remove(id)
+	return copyBook(book), nil
+}
+
+// Delete removes the book with the given ID
+func (r *InMemoryBookRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.books[id]; !ok {
+		return ErrBookNotFound
+	}
+	r.remove(id)
+	return nil
+}
+
+// Merge applies merge to the two books, stores the result under keepID and
+// deletes removeID, all under one write lock. It returns the change to
+// keepID and the book removed.
+func (r *InMemoryBookRepository) Merge(keepID, removeID string, merge func(keep, remove *Book)) (BookChange, *Book, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keep, ok := r.books[keepID]
+	if !ok {
+		return BookChange{}, nil, fmt.Errorf("%w: %s", ErrBookNotFound, keepID)
+	}
+	remove, ok := r.books[removeID]
+	if !ok {
+		return BookChange{}, nil, fmt.Errorf("%w: %s", ErrBookNotFound, removeID)
+	}
+
+	merged := copyBook(keep)
+	merge(merged, copyBook(remove))
+	merged.ID = keepID
+	merged.CreatedAt = keep.CreatedAt
+	merged.UpdatedAt = r.clock.Now()
+	r.put(merged)
+	r.remove(removeID)
+	return BookChange{Before: copyBook(keep), After: copyBook(merged)}, copyBook(remove), nil
+}
+
+// UpdateMany applies update to each listed book and stores the results,
+// returning the change to each in the order of ids. Unknown IDs are skipped
+// and returned in missing; with allOrNothing any unknown ID leaves every
+// book unchanged and ErrBookNotFound is returned.
+func (r *InMemoryBookRepository) UpdateMany(ids []string, allOrNothing bool, update func(book *Book)) ([]BookChange, []string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var missing []string
+	for _, id := range ids {
+		if _, ok := r.books[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if allOrNothing && len(missing) > 0 {
+		return nil, missing, fmt.Errorf("%w: %s", ErrBookNotFound, strings.Join(missing, ", "))
+	}
+
+	now := r.clock.Now()
+	changes := make([]BookChange, 0, len(ids)-len(missing))
+	for _, id := range ids {
+		stored, ok := r.books[id]
+		if !ok {
+			continue
+		}
+		book := copyBook(stored)
+		update(book)
+		book.ID = id
+		book.CreatedAt = stored.CreatedAt
+		book.UpdatedAt = now
+		r.put(book)
+		changes = append(changes, BookChange{Before: copyBook(stored), After: copyBook(book)})
+	}
+	return changes, missing, nil
+}
+
+// UpdateWhere applies update to a copy of every book matching match and
+// stores the results, all under one lock so no write interleaves. It
+// returns the change to each book in ID order.
+func (r *InMemoryBookRepository) UpdateWhere(match func(book *Book) bool, update func(book *Book)) ([]BookChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var matched []*Book
+	for _, stored := range r.books {
+		if match(stored) {
+			matched = append(matched, stored)
+		}
+	}
+	sortBooksByID(matched)
+
+	now := r.clock.Now()
+	changes := make([]BookChange, len(matched))
+	for i, stored := range matched {
+		book := copyBook(stored)
+		update(book)
+		book.ID = stored.ID
+		book.CreatedAt = stored.CreatedAt
+		book.UpdatedAt = now
+		r.put(book)
+		changes[i] = BookChange{Before: copyBook(stored), After: copyBook(book)}
+	}
+	return changes, nil
+}
+
+// Reassign moves the book stored under id to newID, which must be unused.
+// A numeric newID beyond the counter advances it so later creates skip it.
+// The change runs from the book under id to the book under newID.
+func (r *InMemoryBookRepository) Reassign(id, newID string) (BookChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	book, ok := r.books[id]
+	if !ok {
+		return BookChange{}, ErrBookNotFound
+	}
+	if _, taken := r.books[newID]; taken {
+		return BookChange{}, fmt.Errorf("%w: %s", ErrBookExists, newID)
+	}
+
+	moved := copyBook(book)
+	moved.ID = newID
+	r.remove(id)
+	r.put(moved)
+	if n, err := strconv.Atoi(newID); err == nil && n > r.nextID {
+		r.nextID = n
+	}
+	return BookChange{Before: copyBook(book), After: copyBook(moved)}, nil
+}
+
+// Changes returns up to limit changes made after the since token, with the
+// token to continue from. Tokens that are too old for the change log, or
+// from before a restart or restore, fail with ErrChangesExpired.
+func (r *InMemoryBookRepository) Changes(since string, limit int) (*ChangeFeed, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.changes.since(since, limit)
+}
+
+// AuthorCounts returns the number of books per listed author, so a book
+// with several authors counts once for each. Authors are told apart by
+// authorGroupKey, as GroupByAuthor does, and keyed by their most common
+// spelling. The counts are kept up to date on every write, so this costs
+// O(authors) rather than O(books).
+func (r *InMemoryBookRepository) AuthorCounts() (map[string]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[string]int, len(r.authorCounts))
+	for _, count := range r.authorCounts {
+		counts[count.name()] = count.n
+	}
+	return counts, nil
+}
+
+// ISBNs returns the IDs of the books carrying each normalized ISBN, read
+// from the ISBN index. Books without an ISBN are not included.
+func (r *InMemoryBookRepository) ISBNs() (map[string][]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	isbns := make(map[string][]string, len(r.isbnIndex))
+	for isbn, ids := range r.isbnIndex {
+		for id := range ids {
+			isbns[isbn] = append(isbns[isbn], id)
+		}
+	}
+	return isbns, nil
+}
+
+// FindByISBN returns the books whose ISBN matches isbn after normalization,
+// ordered by ID, using the ISBN index
+func (r *InMemoryBookRepository) FindByISBN(isbn string) ([]*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var books []*Book
+	for id := range r.isbnIndex[normalizeISBN(isbn)] {
+		books = append(books, copyBook(r.books[id]))
+	}
+	sortBooksByID(books)
+	return books, nil
+}
+
+// SearchByGenre returns books whose genre equals genre ignoring case,
+// ordered by ID, using the genre index
+func (r *InMemoryBookRepository) SearchByGenre(genre string) ([]*Book, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	books := make([]*Book, 0)
+	for id := range r.genreIndex[genreKey(genre)] {
+		books = append(books, copyBook(r.books[id]))
+	}
+	sortBooksByID(books)
+	return books, nil
+}
+
+// SearchByISBNPrefix returns books whose normalized ISBN starts with the
+// normalized prefix, ordered by ID
+func (r *InMemoryBookRepository) SearchByISBNPrefix(prefix string) ([]*Book, error) {
+	return r.SearchByISBNPrefixContext(context.Background(), prefix)
+}
+
+// SearchByISBNPrefixContext is SearchByISBNPrefix, giving up once ctx is done.
+// It scans the ISBN index rather than every book.
+func (r *InMemoryBookRepository) SearchByISBNPrefixContext(ctx context.Context, prefix string) (books []*Book, err error) {
+	_, span := startSpan(ctx, "BookRepository.SearchByISBNPrefix")
+	defer func() { endSpan(span, err) }()
+	prefix = normalizeISBN(prefix)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	books = make([]*Book, 0)
+	scanned := 0
+	for isbn, ids := range r.isbnIndex {
+		if scanned%searchCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		scanned++
+		if !strings.HasPrefix(isbn, prefix) {
+			continue
+		}
+		for id := range ids {
+			books = append(books, copyBook(r.books[id]))
+		}
+	}
+	sortBooksByID(books)
+	return books, nil
+}
+
+// SearchByAuthor returns books whose author contains the given text (case-insensitive)
+func (r *InMemoryBookRepository) SearchByAuthor(author string) ([]*Book, error) {
+	return r.SearchByAuthorContext(context.Background(), author)
+}
+
+// SearchByAuthorContext is SearchByAuthor, giving up once ctx is done.
+// Books may list several authors separated by semicolons; a term matches
+// when it occurs within any one of them, or anywhere when it contains a
+// semicolon itself.
+func (r *InMemoryBookRepository) SearchByAuthorContext(ctx context.Context, author string) ([]*Book, error) {
+	if strings.Contains(author, authorSeparator) {
+		return r.search(ctx, "SearchByAuthor", func(b *Book) bool {
+			return containsFold(b.Author, author)
+		})
+	}
+	if r.normalizeAuthors {
+		key := normalizeName(author)
+		return r.search(ctx, "SearchByAuthor", func(b *Book) bool {
+			return strings.Contains(r.authorKeys[b.ID], key)
+		})
+	}
+	return r.search(ctx, "SearchByAuthor", func(b *Book) bool {
+		for _, name := range splitAuthors(b.Author) {
+			if containsFold(name, author) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// authorKey is the normalized form of each author of an Author field,
+// joined by NUL, which normalized search terms never contain, so a term
+// cannot match across two authors
+func authorKey(author string) string {
+	names := splitAuthors(author)
+	for i, name := range names {
+		names[i] = normalizeName(name)
+	}
+	return strings.Join(names, "\x00")
+}
+
+// SearchByTitle returns books whose title contains the given text (case-insensitive)
+func (r *InMemoryBookRepository) SearchByTitle(title string) ([]*Book, error) {
+	return r.SearchByTitleContext(context.Background(), title)
+}
+
+// SearchByTitleContext is SearchByTitle, giving up once ctx is done
+func (r *InMemoryBookRepository) SearchByTitleContext(ctx context.Context, title string) ([]*Book, error) {
+	return r.search(ctx, "SearchByTitle", func(b *Book) bool {
+		return containsFold(b.Title, title)
+	})
+}
+
+// SearchByDescription returns books whose description contains every
+// space-separated word of term (case-insensitive)
+func (r *InMemoryBookRepository) SearchByDescription(term string) ([]*Book, error) {
+	return r.SearchByDescriptionContext(context.Background(), term)
+}
+
+// SearchByDescriptionContext is SearchByDescription, giving up once ctx is done
+func (r *InMemoryBookRepository) SearchByDescriptionContext(ctx context.Context, term string) ([]*Book, error) {
+	words := strings.Fields(term)
+	return r.search(ctx, "SearchByDescription", func(b *Book) bool {
+		return containsAllFold(b.Description, words)
+	})
+}
+
+// SearchByYear returns books whose PublishedYear is exactly year
+func (r *InMemoryBookRepository) SearchByYear(year int) ([]*Book, error) {
+	return r.search(context.Background(), "SearchByYear", func(b *Book) bool {
+		return b.PublishedYear == year
+	})
+}
+
+// ForEach calls fn for each book in ID order, stopping at the first error
+// from fn or ctx. It holds the read lock throughout, so fn must not call
+// methods that modify the repository.
+func (r *InMemoryBookRepository) ForEach(ctx context.Context, fn func(*Book) error) (err error) {
+	_, span := startSpan(ctx, "BookRepository.ForEach")
+	defer func() { endSpan(span, err) }()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.books))
+	for id := range r.books {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(copyBook(r.books[id])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchCheckInterval is how many books a search scans between checks of
+// its context
+const searchCheckInterval = 64
+
+// search returns copies of all books matching the predicate, ordered by ID.
+// It stops with ctx.Err() once ctx is done. op names the search in traces.
+func (r *InMemoryBookRepository) search(ctx context.Context, op string, match func(*Book) bool) (books []*Book, err error) {
+	_, span := startSpan(ctx, "BookRepository."+op)
+	defer func() { endSpan(span, err) }()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	books = make([]*Book, 0)
+	scanned := 0
+	for _, book := range r.books {
+		if scanned%searchCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		scanned++
+		if match(book) {
+			books = append(books, copyBook(book))
+		}
+	}
+	sortBooksByID(books)
+	return books, nil
+}
+
+// repositorySnapshot is the serialized form of an InMemoryBookRepository
+type repositorySnapshot struct {
+	NextID int     `json:"nextId"`
+	Books  []*Book `json:"books"`
+}
+
+// Snapshot serializes the entire store, including the ID counter, as JSON
+func (r *InMemoryBookRepository) Snapshot() ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snap := repositorySnapshot{
+		NextID: r.nextID,
+		Books:  make([]*Book, 0, len(r.books)),
+	}
+	for _, book := range r.books {
+		snap.Books = append(snap.Books, book)
+	}
+	sortBooksByID(snap.Books)
+	return json.Marshal(snap)
+}
+
+// Restore replaces the store with the contents of a Snapshot.
+// The payload is fully validated before anything is replaced.
+func (r *InMemoryBookRepository) Restore(data []byte) error {
+	var snap repositorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if snap.NextID < 0 {
+		return errors.New("invalid snapshot: negative nextId")
+	}
+
+	seen := make(map[string]bool, len(snap.Books))
+	for i, book := range snap.Books {
+		if book == nil || book.ID == "" {
+			return fmt.Errorf("invalid snapshot: book %d has no id", i)
+		}
+		if seen[book.ID] {
+			return fmt.Errorf("invalid snapshot: duplicate id %q", book.ID)
+		}
+		if n, err := strconv.Atoi(book.ID); err == nil && n > snap.NextID {
+			return fmt.Errorf("invalid snapshot: id %q is beyond nextId %d", book.ID, snap.NextID)
+		}
+		seen[book.ID] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	for _, book := range snap.Books {
+		r.put(book)
+	}
+	r.nextID = snap.NextID
+	return nil
+}
@@ -0,0 +1,148 @@
+package bookapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrorResponse represents an error response
+type ErrorResponse struct {
+	StatusCode int          `json:"-"`
+	Error      string       `json:"error"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	ErrorID    string       `json:"errorId,omitempty"`
+}
+
+// newErrorID returns a random ID correlating an error response with its log entry
+func newErrorID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Helper functions
+
+// writeJSON encodes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encodeJSON(w, v)
+}
+
+// encodeJSON writes v as JSON to w, with authors in the display form when
+// w is an authorDisplayWriter
+func encodeJSON(w http.ResponseWriter, v interface{}) {
+	dw, ok := w.(*authorDisplayWriter)
+	if !ok {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			logger.Error("failed to encode response", "error", err)
+		}
+		return
+	}
+	var encoded bytes.Buffer
+	err := json.NewEncoder(&encoded).Encode(v)
+	if err == nil {
+		var display []byte
+		if display, err = displayAuthors(encoded.Bytes(), dw.format); err == nil {
+			_, err = w.Write(append(display, '\n'))
+		}
+	}
+	if err != nil {
+		logger.Error("failed to encode response", "error", err)
+	}
+}
+
+// writeError writes an ErrorResponse with the given status
+func writeError(w http.ResponseWriter, status int, message string) {
+	resp := ErrorResponse{StatusCode: status, Error: message}
+	writeJSON(w, resp.StatusCode, resp)
+}
+
+// jsonErrorWriter holds back plain-text error responses, such as those
+// net/http helpers write with http.Error, so finish can send them through
+// writeError instead
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader holds back plain-text errors and passes everything else on
+func (jw *jsonErrorWriter) WriteHeader(status int) {
+	mediaType, _, _ := mime.ParseMediaType(jw.Header().Get("Content-Type"))
+	if status >= 400 && mediaType == "text/plain" {
+		jw.status = status
+		return
+	}
+	jw.ResponseWriter.WriteHeader(status)
+}
+
+// Write buffers the body of a held-back error
+func (jw *jsonErrorWriter) Write(p []byte) (int, error) {
+	if jw.status != 0 {
+		return jw.body.Write(p)
+	}
+	return jw.ResponseWriter.Write(p)
+}
+
+// finish sends a held-back error as an ErrorResponse. The error replaces
+// the content, so a Content-Disposition naming a download is dropped.
+func (jw *jsonErrorWriter) finish() {
+	if jw.status != 0 {
+		jw.Header().Del("Content-Disposition")
+		writeError(jw.ResponseWriter, jw.status, strings.TrimSpace(jw.body.String()))
+	}
+}
+
+// handleUnknownPath answers paths no route matches, which ServeMux would
+// otherwise answer with a plain-text 404
+func handleUnknownPath(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no endpoint at %s", r.URL.Path))
+}
+
+// writeServiceError maps service errors to HTTP status codes
+func (h *BookHandler) writeServiceError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error(), Fields: verr.Fields})
+	case errors.Is(err, ErrBookNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrBookExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrCapacityExceeded):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrChangesExpired):
+		writeError(w, http.StatusGone, err.Error())
+	case errors.Is(err, ErrHistoryUnavailable):
+		writeError(w, http.StatusNotImplemented, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		writeError(w, http.StatusServiceUnavailable, "request timed out or was canceled")
+	case errors.Is(err, ErrInvalidBook):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		// The message may leak internals, so unless ErrorDetail is set clients
+		// only get an ID to quote, which matches the log entry
+		id := newErrorID()
+		logger.Error("internal error", "error", err, "error_id", id)
+		msg := "internal server error"
+		if h.ErrorDetail {
+			msg = err.Error()
+		}
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: msg, ErrorID: id})
+	}
+}
+
+// writeMethodNotAllowed writes a 405 listing the allowed methods
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
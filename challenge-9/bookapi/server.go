@@ -0,0 +1,284 @@
+package bookapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// NewRouter registers the book endpoints on a new ServeMux
+func NewRouter(handler *BookHandler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/books", handler.Gate(handler.HandleBooks))
+	mux.HandleFunc("/api/books/", handler.Gate(handler.HandleBooks))
+	mux.HandleFunc("/healthz", handler.HandleHealth)
+	mux.HandleFunc("/openapi.json", OpenAPIHandler())
+	mux.HandleFunc("/api/version", HandleVersion)
+	mux.HandleFunc("/", handleUnknownPath)
+	return mux
+}
+
+// Endpoint groups that can be disabled; reads of books outside search and
+// export are always served
+const (
+	EndpointWrites = "writes"
+	EndpointSearch = "search"
+	EndpointExport = "export"
+	EndpointAdmin  = "admin"
+)
+
+// endpointGroups lists the groups --disable-endpoints accepts
+var endpointGroups = []string{EndpointWrites, EndpointSearch, EndpointExport, EndpointAdmin}
+
+// endpointGroup names the group serving a request, or "" when it belongs
+// to none. Writes are the book requests read-only mode rejects.
+func endpointGroup(r *http.Request) string {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(path, "/api/admin/"):
+		return EndpointAdmin
+	case path == "/api/books/export":
+		return EndpointExport
+	case path == "/api/books/search" || path == "/api/books/by-author":
+		return EndpointSearch
+	case isDryRunImport(r):
+		return ""
+	case isMutating(r.Method) && (path == "/api/books" || strings.HasPrefix(path, "/api/books/")):
+		return EndpointWrites
+	}
+	return ""
+}
+
+// isDryRunImport reports whether r asks for an import dry run, which
+// stores nothing and so is not a write
+func isDryRunImport(r *http.Request) bool {
+	if r.Method != http.MethodPost || strings.TrimSuffix(r.URL.Path, "/") != "/api/books/import" {
+		return false
+	}
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return err == nil && dryRun
+}
+
+// Gate wraps a route so requests to a disabled endpoint group are answered
+// with DisabledStatus instead of reaching it
+func (h *BookHandler) Gate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := endpointGroup(r)
+		if !h.DisabledEndpoints[group] {
+			next(w, r)
+			return
+		}
+		if h.DisabledStatus == http.StatusMethodNotAllowed {
+			if group == EndpointWrites {
+				writeMethodNotAllowed(w, http.MethodGet, http.MethodHead)
+			} else {
+				writeMethodNotAllowed(w)
+			}
+			return
+		}
+		handleUnknownPath(w, r)
+	}
+}
+
+// shutdownTimeout bounds how long open requests may take to finish once a
+// shutdown signal arrives
+const shutdownTimeout = 10 * time.Second
+
+// Main parses the command-line flags and runs the server until it is shut
+// down, exiting the process on failure
+func Main() {
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+
+	logLevel := new(slog.LevelVar)
+	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: invalid log level %q\n", cfg.LogLevel)
+		os.Exit(2)
+	}
+	l, err := newLeveledLogger(os.Stderr, logLevel, cfg.LogFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+	logger = l
+	var provider *sdktrace.TracerProvider
+	if cfg.OTLPEndpoint != "" {
+		provider, err = newTracerProvider(context.Background(), cfg.OTLPEndpoint, "books", cfg.TraceSampleRatio)
+		if err != nil {
+			logger.Error("failed to create trace exporter", "error", err)
+			os.Exit(1)
+		}
+		otel.SetTracerProvider(provider)
+	}
+
+	// Initialize the repository, service, and handler, all reading one clock
+	clock := Clock(realClock{})
+	repoOpts := []RepositoryOption{WithChangeLogSize(cfg.ChangeLogSize), WithClock(clock)}
+	if cfg.NormalizeAuthors {
+		repoOpts = append(repoOpts, WithAuthorNormalization())
+	}
+	if cfg.UniqueISBNs {
+		repoOpts = append(repoOpts, WithUniqueISBNs())
+	}
+	if cfg.MaxBooks > 0 {
+		repoOpts = append(repoOpts, WithMaxBooks(cfg.MaxBooks))
+	}
+	if cfg.MaxDescriptionLength > 0 {
+		repoOpts = append(repoOpts, WithMaxDescriptionLength(cfg.MaxDescriptionLength))
+	}
+	var repo BookRepository = NewInMemoryBookRepository(repoOpts...)
+	if cfg.DataFile != "" {
+		fileRepo, err := NewFileBookRepository(cfg.DataFile, repoOpts...)
+		if err != nil {
+			logger.Error("failed to open data file", "path", cfg.DataFile, "error", err)
+			os.Exit(1)
+		}
+		if cfg.FlushInterval > 0 {
+			fileRepo.SetFlushInterval(cfg.FlushInterval, cfg.FlushAfter)
+		}
+		repo = fileRepo
+	}
+	serviceOpts := []ServiceOption{
+		WithTrimming(!cfg.NoTrim),
+		WithDefaultGenre(cfg.DefaultGenre),
+		WithValidator(DefaultValidator{MaxAuthors: cfg.MaxAuthors, RequireISBN: cfg.ISBNPolicy == isbnPolicyRequired}),
+		WithServiceClock(clock),
+	}
+	if cfg.AuditLog != "" {
+		auditLog, err := OpenAuditLog(cfg.AuditLog, WithAuditClock(clock))
+		if err != nil {
+			logger.Error("failed to open audit log", "path", cfg.AuditLog, "error", err)
+			os.Exit(1)
+		}
+		serviceOpts = append(serviceOpts, WithAuditLog(auditLog))
+	}
+	service, err := NewCheckedBookService(repo, serviceOpts...)
+	if err != nil {
+		logger.Error("failed to create service", "error", err)
+		os.Exit(1)
+	}
+	handler, err := NewCheckedBookHandler(service)
+	if err != nil {
+		logger.Error("failed to create handler", "error", err)
+		os.Exit(1)
+	}
+	handler.Idempotency = NewIdempotencyStore(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys)
+	handler.Idempotency.clock = clock
+	handler.MissingAsEmpty = cfg.MissingAsEmpty
+	handler.EmptySearch404 = cfg.EmptySearch404
+	handler.DefaultSort = cfg.DefaultSort
+	handler.AuthorFormat = cfg.AuthorFormat
+	handler.StrictJSON = cfg.StrictJSON
+	handler.MaxSearchResults = cfg.MaxSearchResults
+	handler.SearchSummaryThreshold = cfg.SearchSummaryThreshold
+	handler.BaseURL = cfg.BaseURL
+	handler.SearchTimeout = cfg.SearchTimeout
+	handler.ErrorDetail = cfg.ErrorDetail
+	handler.MaxBatchItems = cfg.MaxBatchItems
+	handler.MaxBodyBytes = cfg.MaxBodyBytes
+	handler.ImportURLTimeout = cfg.ImportURLTimeout
+	handler.ImportURLMaxBytes = cfg.ImportURLMaxBytes
+	handler.ImportURLHosts = cfg.ImportURLHosts
+	handler.ListETags = !cfg.NoListETag
+	handler.PatchUpsert = cfg.PatchUpsert
+	handler.MaxSearchTerm = cfg.MaxSearchTerm
+	handler.FuzzyMaxDistance = cfg.FuzzyMaxDistance
+	handler.DisabledEndpoints = cfg.DisabledEndpoints
+	handler.DisabledStatus = cfg.DisabledStatus
+
+	readOnly := &ReadOnlyMode{}
+	readOnly.Set(cfg.ReadOnly)
+
+	if cfg.ConfigFile != "" {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go NewConfigReloader(os.Args[1:], cfg, readOnly, logLevel).Watch(hangups)
+	}
+
+	mux := NewRouter(handler)
+	var inner http.Handler = ResponseFormatMiddleware(cfg.DefaultContentType, readOnly.Middleware(mux))
+	if len(cfg.GzipTypes) > 0 {
+		inner = GzipMiddleware(cfg.GzipMinSize, cfg.GzipTypes, inner)
+	}
+	if cfg.SlowRequestThreshold > 0 {
+		inner = SlowRequestMiddleware(cfg.SlowRequestThreshold, inner)
+	}
+	if cfg.MaxURLLength > 0 || cfg.MaxQueryParams > 0 {
+		inner = URLLimitMiddleware(cfg.MaxURLLength, cfg.MaxQueryParams, inner)
+	}
+	if cfg.MaxInFlight > 0 {
+		// Inside logging, so rejected requests are still logged
+		inner = ConcurrencyLimitMiddleware(cfg.MaxInFlight, inner)
+	}
+	var root http.Handler = LoggingMiddleware(inner)
+	// Outermost of the request-scoped layers, so the span covers them all
+	root = TracingMiddleware(root)
+	if len(cfg.APIKeys) > 0 {
+		// Admin endpoints are only exposed when they can be protected
+		mux.HandleFunc("/api/admin/read-only", handler.Gate(readOnly.HandleToggle))
+		mux.HandleFunc("/api/admin/repo-info", handler.Gate(RepoInfoHandler(repo)))
+		root = APIKeyMiddleware(cfg.APIKeyHeader, cfg.APIKeys, root)
+	}
+	// Outside auth, so 401s and 403s are converted as well
+	root = ProblemJSONMiddleware(cfg.ProblemJSON, root)
+	if len(cfg.CORSOrigins) > 0 {
+		// Preflights carry no credentials, so CORS sits in front of auth
+		root = CORSMiddleware(cfg.CORSOrigins, cfg.CORSMaxAge, root)
+	}
+
+	// Start the server
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		logger.Error("failed to listen", "addr", cfg.Addr, "error", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: root}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		logger.Info("server shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error("failed to finish open requests", "error", err)
+		}
+	}()
+	logger.Info("server starting", "addr", cfg.Addr, "tls", cfg.TLSCert != "")
+	if err := serve(srv, ln, cfg); !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("failed to start server", "error", err)
+		os.Exit(1)
+	}
+	<-stopped
+	// Send the spans still queued
+	if provider != nil {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			logger.Error("failed to export trace spans", "error", err)
+		}
+	}
+	// Persist writes that are still waiting to be flushed
+	if closer, ok := repo.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("failed to close repository", "error", err)
+			os.Exit(1)
+		}
+	}
+}
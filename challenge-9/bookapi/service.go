@@ -0,0 +1,1679 @@
+package bookapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BookService defines the business logic for book operations
+type BookService interface {
+	GetAllBooks() ([]*Book, error)
+	GetBookByID(id string) (*Book, error)
+	GetBookByIDContext(ctx context.Context, id string) (*Book, error)
+	ResolveBook(key string) (book *Book, matchedBy string, err error)
+	GetBooksByIDs(ids []string) (books []*Book, missing []string, err error)
+	CreateBook(book *Book) error
+	CreateBookContext(ctx context.Context, book *Book) error
+	CreateBooks(books []*Book) (*BatchSummary, error)
+	DryRunCreates() func(book *Book) error
+	UpdateBook(id string, book *Book) error
+	UpdateBookContext(ctx context.Context, id string, book *Book) error
+	PatchBook(id string, upsert bool, apply func(*Book) error) (book *Book, created bool, err error)
+	PatchBookContext(ctx context.Context, id string, upsert bool, apply func(*Book) error) (book *Book, created bool, err error)
+	DeleteBook(id string) error
+	DeleteBookContext(ctx context.Context, id string) error
+	MergeBooks(keepID, removeID string) (*Book, error)
+	ReassignBookID(id, newID string) (*Book, error)
+	IncrementField(id, field string, delta int) (int, error)
+	TouchBook(id string) (*Book, error)
+	PopBook(id string) (*Book, error)
+	SearchBooksByAuthor(author string) ([]*Book, error)
+	SearchBooksByTitle(title string) ([]*Book, error)
+	SearchBooksByDescription(term string) ([]*Book, error)
+	SearchBooksByAuthorContext(ctx context.Context, author string) ([]*Book, error)
+	SearchBooksByTitleContext(ctx context.Context, title string) ([]*Book, error)
+	SearchBooksByDescriptionContext(ctx context.Context, term string) ([]*Book, error)
+	SearchBooksByISBNPrefix(prefix string) ([]*Book, error)
+	SearchBooksByYear(year int) ([]*Book, error)
+	GetBooksByIDRange(from, to int) ([]*Book, error)
+	SearchBooksByGenre(genre string) ([]*Book, error)
+	SearchBooksByISBNPrefixContext(ctx context.Context, prefix string) ([]*Book, error)
+	FuzzySearch(ctx context.Context, field, term string, maxDistance, maxCandidates int) (books []*Book, truncated bool, err error)
+	ValidateBook(book *Book) error
+	GetExtremes() (oldest, newest *Book, err error)
+	GetRecentBooks(limit int) ([]*Book, error)
+	CountByDecade(includeEmpty bool) ([]DecadeCount, error)
+	IndexByInitial(field string, withIDs bool) (map[string]*InitialCount, error)
+	FindDuplicates(by string) ([]DuplicateCluster, error)
+	FindIncomplete(missing []string) ([]*Book, error)
+	Quality() (*QualityReport, error)
+	GroupByAuthor(offset, limit, perAuthor int) (groups []AuthorGroup, total int, err error)
+	TopAuthors(limit int) ([]AuthorCount, error)
+	PopularBooks(limit int) ([]BookViews, error)
+	BookHistory(id string) (*BookWithHistory, error)
+	Changes(since string, limit int) (*ChangeFeed, error)
+	ListISBNs() ([]ISBNEntry, error)
+	CategorizeBooks(ids []string, genre string, transactional bool) (*BulkUpdateSummary, error)
+	SetGenreByAuthor(author, genre string) (int, error)
+	DeleteBooks(ids []string) (*BulkDeleteSummary, error)
+}
+
+// BookValidator checks a book before it is created, updated or validated.
+// Rejections should be a *ValidationError or wrap ErrInvalidBook so they
+// are reported as 400 Bad Request.
+type BookValidator interface {
+	Validate(book *Book) error
+}
+
+// DefaultValidator enforces the built-in rules: title and author are
+// required, the year is not negative and text fields hold no control
+// characters. MaxAuthors, when positive, caps the semicolon-separated authors,
+// and RequireISBN demands an ISBN with a valid check digit.
+type DefaultValidator struct {
+	MaxAuthors  int
+	RequireISBN bool
+}
+
+// Validate implements BookValidator
+func (v DefaultValidator) Validate(book *Book) error {
+	err := validateBook(book)
+	if book == nil {
+		return err
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		verr = &ValidationError{}
+	}
+	if n := len(splitAuthors(book.Author)); v.MaxAuthors > 0 && n > v.MaxAuthors {
+		verr.add("author", fmt.Sprintf("lists %d authors, at most %d are allowed", n, v.MaxAuthors))
+	}
+	if v.RequireISBN {
+		if strings.TrimSpace(book.ISBN) == "" {
+			verr.add("isbn", "is required")
+		} else if _, _, cerr := checkISBN(book.ISBN); cerr != nil {
+			verr.add("isbn", "is not valid: "+cerr.Error())
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// ISBN policies for --isbn-policy
+const (
+	isbnPolicyOptional   = "optional"
+	isbnPolicyRequired   = "required"
+	isbnPolicyUniqueOnly = "unique-only"
+)
+
+// authorSeparator separates the authors of a book with several. Commas
+// cannot, since they appear within names such as "Tolkien, J.R.R." and
+// in the last-first display format.
+const authorSeparator = ";"
+
+// splitAuthors returns the authors of an Author field, trimmed and without
+// empty entries
+func splitAuthors(author string) []string {
+	var authors []string
+	for _, name := range strings.Split(author, authorSeparator) {
+		if name = strings.TrimSpace(name); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	return authors
+}
+
+// DefaultBookService implements BookService
+type DefaultBookService struct {
+	repo      BookRepository
+	validator BookValidator
+	audit     *AuditLog
+	// trim strips surrounding whitespace from text fields before validation
+	trim bool
+	// views counts successful GetBookByID calls per book ID
+	views *viewCounter
+	// defaultGenre is given to books stored without a genre; empty leaves it unset
+	defaultGenre string
+	// clock gives the current year that published years may not exceed
+	clock Clock
+}
+
+// ServiceOption configures a DefaultBookService
+type ServiceOption func(*DefaultBookService)
+
+// WithValidator replaces the default validation rules; nil keeps the defaults
+func WithValidator(v BookValidator) ServiceOption {
+	return func(s *DefaultBookService) {
+		if v != nil {
+			s.validator = v
+		}
+	}
+}
+
+// WithAuditLog records every create, update and delete in log
+func WithAuditLog(log *AuditLog) ServiceOption {
+	return func(s *DefaultBookService) {
+		s.audit = log
+	}
+}
+
+// WithTrimming controls whether surrounding whitespace is stripped from
+// text fields before books are stored; it is on by default
+func WithTrimming(enabled bool) ServiceOption {
+	return func(s *DefaultBookService) {
+		s.trim = enabled
+	}
+}
+
+// WithDefaultGenre sets the genre given to books created or updated
+// without one, so with it set a genre can no longer be cleared
+func WithDefaultGenre(genre string) ServiceOption {
+	return func(s *DefaultBookService) {
+		s.defaultGenre = strings.TrimSpace(genre)
+	}
+}
+
+// WithServiceClock sets the clock for the service's own time checks,
+// normally the one given to the repository with WithClock
+func WithServiceClock(c Clock) ServiceOption {
+	return func(s *DefaultBookService) {
+		s.clock = c
+	}
+}
+
+// Tombstone stands in for a deleted book that still has history
+type Tombstone struct {
+	ID        string    `json:"id"`
+	Deleted   bool      `json:"deleted"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// BookWithHistory is a book, or its tombstone once deleted, together with
+// its audit history, oldest entry first
+type BookWithHistory struct {
+	Book      *Book        `json:"book,omitempty"`
+	Tombstone *Tombstone   `json:"tombstone,omitempty"`
+	History   []AuditEntry `json:"history"`
+}
+
+// NewBookService creates a new book service. It panics if repo is nil; use
+// NewCheckedBookService to get ErrNilRepository instead.
+func NewBookService(repo BookRepository, opts ...ServiceOption) *DefaultBookService {
+	s, err := NewCheckedBookService(repo, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewCheckedBookService creates a new book service, returning
+// ErrNilRepository if repo is nil
+func NewCheckedBookService(repo BookRepository, opts ...ServiceOption) (*DefaultBookService, error) {
+	if isNil(repo) {
+		return nil, ErrNilRepository
+	}
+	s := &DefaultBookService{
+		repo:      repo,
+		validator: DefaultValidator{},
+		trim:      true,
+		views:     newViewCounter(),
+		clock:     realClock{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// record writes an audit entry if auditing is enabled. before and after
+// come from the write itself, so no other write can come between them.
+// The change is already stored, so a failed write is logged rather than
+// returned.
+func (s *DefaultBookService) record(op, id string, before, after *Book) {
+	if s.audit == nil {
+		return
+	}
+	if err := s.audit.Record(op, id, before, after); err != nil {
+		logger.Error("failed to write audit entry", "op", op, "book_id", id, "error", err)
+	}
+}
+
+// prepare trims book, unless disabled, fills in the default genre and
+// validates it before it is stored, whether created or updated
+func (s *DefaultBookService) prepare(book *Book) error {
+	if book != nil && s.defaultGenre != "" && strings.TrimSpace(book.Genre) == "" {
+		book.Genre = s.defaultGenre
+	}
+	if s.trim && book != nil {
+		book.Title = strings.TrimSpace(book.Title)
+		book.Author = strings.TrimSpace(book.Author)
+		book.ISBN = strings.TrimSpace(book.ISBN)
+		book.Description = strings.TrimSpace(book.Description)
+		book.Genre = strings.TrimSpace(book.Genre)
+	}
+	return s.validate(book)
+}
+
+// validate runs the validator and then rejects a published year after the
+// current year of s.clock, which no validator can know
+func (s *DefaultBookService) validate(book *Book) error {
+	err := s.validator.Validate(book)
+	if book == nil {
+		return err
+	}
+	year := s.clock.Now().Year()
+	if book.PublishedYear <= year {
+		return err
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		if err != nil {
+			return err
+		}
+		verr = &ValidationError{}
+	}
+	verr.add("publishedYear", fmt.Sprintf("must not be after %d", year))
+	return verr
+}
+
+// RepositoryInfo describes the repository, if it reports its internals
+func (s *DefaultBookService) RepositoryInfo() (RepositoryInfo, bool) {
+	provider, ok := s.repo.(interface{ Info() RepositoryInfo })
+	if !ok {
+		return RepositoryInfo{}, false
+	}
+	return provider.Info(), true
+}
+
+// ListVersion reports the repository's list version, if it keeps one
+func (s *DefaultBookService) ListVersion() (string, bool) {
+	versioner, ok := s.repo.(interface{ ListVersion() string })
+	if !ok {
+		return "", false
+	}
+	return versioner.ListVersion(), true
+}
+
+// GetAllBooks returns all books
+func (s *DefaultBookService) GetAllBooks() ([]*Book, error) {
+	return s.repo.GetAll()
+}
+
+// GetBooksByIDs returns the stored books among ids in request order, and
+// the IDs that are not stored. Repeated IDs are looked up once.
+func (s *DefaultBookService) GetBooksByIDs(ids []string) ([]*Book, []string, error) {
+	if len(ids) == 0 {
+		return nil, nil, fmt.Errorf("%w: ids is required", ErrInvalidBook)
+	}
+	books := make([]*Book, 0, len(ids))
+	var missing []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		book, err := s.repo.GetByID(id)
+		switch {
+		case errors.Is(err, ErrBookNotFound):
+			missing = append(missing, id)
+		case err != nil:
+			return nil, nil, err
+		default:
+			books = append(books, book)
+		}
+	}
+	return books, missing, nil
+}
+
+// Keys a resolved book can be matched by
+const (
+	ResolvedByID   = "id"
+	ResolvedByISBN = "isbn"
+)
+
+// ResolveBook looks key up as a book ID and then as an ISBN, reporting which
+// one matched. Several books sharing the ISBN resolve to the lowest ID.
+func (s *DefaultBookService) ResolveBook(key string) (*Book, string, error) {
+	if strings.TrimSpace(key) == "" {
+		return nil, "", fmt.Errorf("%w: key is required", ErrInvalidBook)
+	}
+	book, err := s.repo.GetByID(key)
+	if err == nil {
+		return book, ResolvedByID, nil
+	}
+	if !errors.Is(err, ErrBookNotFound) {
+		return nil, "", err
+	}
+	books, err := s.repo.FindByISBN(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(books) == 0 {
+		return nil, "", ErrBookNotFound
+	}
+	return books[0], ResolvedByISBN, nil
+}
+
+// GetBookByID returns a single book
+func (s *DefaultBookService) GetBookByID(id string) (*Book, error) {
+	return s.GetBookByIDContext(context.Background(), id)
+}
+
+// GetBookByIDContext is GetBookByID, traced as a child of the span in ctx
+func (s *DefaultBookService) GetBookByIDContext(ctx context.Context, id string) (_ *Book, err error) {
+	_, span := startSpan(ctx, "BookService.GetBookByID")
+	span.SetAttributes(attribute.String("book.id", id))
+	defer func() { endSpan(span, err) }()
+	if id == "" {
+		return nil, fmt.Errorf("%w: id is required", ErrInvalidBook)
+	}
+	book, err := s.repo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	s.views.add(id)
+	return book, nil
+}
+
+// CreateBook validates and stores a new book
+func (s *DefaultBookService) CreateBook(book *Book) error {
+	return s.CreateBookContext(context.Background(), book)
+}
+
+// CreateBookContext is CreateBook, traced as a child of the span in ctx
+func (s *DefaultBookService) CreateBookContext(ctx context.Context, book *Book) (err error) {
+	_, span := startSpan(ctx, "BookService.CreateBook")
+	defer func() {
+		span.SetAttributes(attribute.String("book.id", book.ID))
+		endSpan(span, err)
+	}()
+	if err := s.prepare(book); err != nil {
+		return err
+	}
+	if err := s.repo.Create(book); err != nil {
+		return err
+	}
+	// Create stamped book as it stored it
+	s.record(AuditCreate, book.ID, nil, book)
+	return nil
+}
+
+// BatchResult reports the outcome for one element of a batch request
+type BatchResult struct {
+	Index int `json:"index"`
+	// Line is the line a CSV row starts on; other batches leave it unset
+	Line  int    `json:"line,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchSummary reports the outcome of a batch request. In a dry run nothing
+// is stored: Created counts the books that would be, and they have no ID.
+// Imports keep at most maxImportResults results, setting ResultsTruncated
+// when more were counted.
+type BatchSummary struct {
+	DryRun           bool          `json:"dryRun,omitempty"`
+	Created          int           `json:"created"`
+	Failed           int           `json:"failed"`
+	Results          []BatchResult `json:"results"`
+	ResultsTruncated bool          `json:"resultsTruncated,omitempty"`
+}
+
+// maxImportResults caps the results an import keeps, so the memory a
+// streamed import needs does not grow with its length
+const maxImportResults = 1000
+
+// addImportResult counts the outcome of one imported element and keeps
+// it while fewer than maxImportResults are kept
+func (s *BatchSummary) addImportResult(result BatchResult) {
+	if result.Error == "" {
+		s.Created++
+	} else {
+		s.Failed++
+	}
+	if len(s.Results) < maxImportResults {
+		s.Results = append(s.Results, result)
+	} else {
+		s.ResultsTruncated = true
+	}
+}
+
+// CreateBooks validates every book and stores the valid ones together.
+// Invalid books are reported in the summary without stopping the others.
+func (s *DefaultBookService) CreateBooks(books []*Book) (*BatchSummary, error) {
+	summary := &BatchSummary{Results: make([]BatchResult, len(books))}
+	valid := make([]*Book, 0, len(books))
+	for i, book := range books {
+		summary.Results[i].Index = i
+		if err := s.prepare(book); err != nil {
+			summary.Results[i].Error = err.Error()
+			summary.Failed++
+			continue
+		}
+		valid = append(valid, book)
+	}
+
+	if err := s.repo.CreateBatch(valid); err != nil {
+		return nil, err
+	}
+	for i, book := range books {
+		if summary.Results[i].Error == "" {
+			summary.Results[i].ID = book.ID
+			summary.Created++
+			s.record(AuditCreate, book.ID, nil, book)
+		}
+	}
+	return summary, nil
+}
+
+// DryRunCreates returns a function that prepares and checks each book
+// passed to it as CreateBook would, counting the books that passed before
+// it as stored, but storing nothing
+func (s *DefaultBookService) DryRunCreates() func(book *Book) error {
+	check := s.repo.CheckCreates()
+	return func(book *Book) error {
+		if err := s.prepare(book); err != nil {
+			return err
+		}
+		return check(book)
+	}
+}
+
+// UpdateBook validates and replaces an existing book
+func (s *DefaultBookService) UpdateBook(id string, book *Book) error {
+	return s.UpdateBookContext(context.Background(), id, book)
+}
+
+// UpdateBookContext is UpdateBook, traced as a child of the span in ctx
+func (s *DefaultBookService) UpdateBookContext(ctx context.Context, id string, book *Book) (err error) {
+	_, span := startSpan(ctx, "BookService.UpdateBook")
+	span.SetAttributes(attribute.String("book.id", id))
+	defer func() { endSpan(span, err) }()
+	if err := s.prepare(book); err != nil {
+		return err
+	}
+	change, err := s.repo.Update(id, book)
+	if err != nil {
+		return err
+	}
+	s.record(AuditUpdate, id, change.Before, change.After)
+	return nil
+}
+
+// PatchBook changes the stored book id with apply, which sets the fields
+// present in a patch, and stores the result if it is still valid. The
+// patch is applied under the repository's write lock, so concurrent
+// patches of one book all take effect. A missing book is ErrBookNotFound
+// unless upsert is set; then apply starts from an empty book and the
+// result is created under id. created reports that the upsert path was
+// taken, also when it then failed.
+func (s *DefaultBookService) PatchBook(id string, upsert bool, apply func(*Book) error) (*Book, bool, error) {
+	return s.PatchBookContext(context.Background(), id, upsert, apply)
+}
+
+// PatchBookContext is PatchBook, traced as a child of the span in ctx
+func (s *DefaultBookService) PatchBookContext(ctx context.Context, id string, upsert bool, apply func(*Book) error) (book *Book, created bool, err error) {
+	_, span := startSpan(ctx, "BookService.PatchBook")
+	span.SetAttributes(attribute.String("book.id", id))
+	defer func() {
+		span.SetAttributes(attribute.Bool("book.created", created))
+		endSpan(span, err)
+	}()
+	change, err := s.repo.UpdateFunc(id, func(stored *Book) error {
+		return s.applyPatch(id, stored, apply, s.prepare)
+	})
+	switch {
+	case err == nil:
+		s.record(AuditUpdate, id, change.Before, change.After)
+		return change.After, false, nil
+	case !errors.Is(err, ErrBookNotFound) || !upsert:
+		return nil, false, err
+	}
+
+	if err := checkClientID("id", id); err != nil {
+		return nil, true, err
+	}
+	book = &Book{ID: id}
+	if err := s.applyPatch(id, book, apply, s.prepare); err != nil {
+		return nil, true, err
+	}
+	if err := s.repo.CreateWithID(book); err != nil {
+		return nil, true, err
+	}
+	s.record(AuditCreate, id, nil, book)
+	return book, true, nil
+}
+
+// applyPatch applies a patch to book and prepares the result, rejecting a
+// patch that changes the ID
+func (s *DefaultBookService) applyPatch(id string, book *Book, apply func(*Book) error, prepare func(*Book) error) error {
+	if err := apply(book); err != nil {
+		return err
+	}
+	if book.ID != id {
+		return fmt.Errorf("%w: body id %q does not match path id %q", ErrInvalidBook, book.ID, id)
+	}
+	return prepare(book)
+}
+
+// DeleteBook removes a book. It pops the book, which reports what was
+// removed for the audit log.
+func (s *DefaultBookService) DeleteBook(id string) error {
+	return s.DeleteBookContext(context.Background(), id)
+}
+
+// DeleteBookContext is DeleteBook, traced as a child of the span in ctx
+func (s *DefaultBookService) DeleteBookContext(ctx context.Context, id string) (err error) {
+	_, span := startSpan(ctx, "BookService.DeleteBook")
+	span.SetAttributes(attribute.String("book.id", id))
+	defer func() { endSpan(span, err) }()
+	before, err := s.repo.Pop(id)
+	if err != nil {
+		return err
+	}
+	s.views.remove(id)
+	s.record(AuditDelete, id, before, nil)
+	return nil
+}
+
+// MergeBooks fills the fields missing on keepID from removeID and then
+// deletes removeID
+func (s *DefaultBookService) MergeBooks(keepID, removeID string) (*Book, error) {
+	if keepID == "" || removeID == "" {
+		return nil, fmt.Errorf("%w: keep and remove are required", ErrInvalidBook)
+	}
+	if keepID == removeID {
+		return nil, fmt.Errorf("%w: keep and remove must be different books", ErrInvalidBook)
+	}
+	kept, removed, err := s.repo.Merge(keepID, removeID, fillMissingFields)
+	if err != nil {
+		return nil, err
+	}
+	s.views.remove(removeID)
+	s.record(AuditUpdate, keepID, kept.Before, kept.After)
+	s.record(AuditDelete, removeID, removed, nil)
+	return kept.After, nil
+}
+
+// maxClientNumericID bounds numeric IDs chosen by clients. Stored numeric
+// IDs advance the ID counter, so a larger one could make it overflow.
+const maxClientNumericID = 1<<53 - 1
+
+// checkClientID rejects an ID a client chose, on reassign or upsert, that
+// the API could not serve: empty, containing a slash, the name of a route
+// under /api/books, or numeric beyond maxClientNumericID. field names the
+// ID in the error.
+func checkClientID(field, id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("%w: %s is required", ErrInvalidBook, field)
+	case strings.Contains(id, "/"):
+		return fmt.Errorf("%w: %s must not contain /", ErrInvalidBook, field)
+	case isRouteName(id):
+		return fmt.Errorf("%w: %s %q is reserved for an endpoint", ErrInvalidBook, field, id)
+	}
+	if n, err := strconv.Atoi(id); (err == nil && n > maxClientNumericID) || errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%w: numeric %s must not exceed %d", ErrInvalidBook, field, maxClientNumericID)
+	}
+	return nil
+}
+
+// ReassignBookID moves a book to a new, unused ID
+func (s *DefaultBookService) ReassignBookID(id, newID string) (*Book, error) {
+	newID = strings.TrimSpace(newID)
+	if err := checkClientID("newId", newID); err != nil {
+		return nil, err
+	}
+	if newID == id {
+		return nil, fmt.Errorf("%w: newId must differ from the current ID", ErrInvalidBook)
+	}
+	change, err := s.repo.Reassign(id, newID)
+	if err != nil {
+		return nil, err
+	}
+	s.views.move(id, newID)
+	s.record(AuditDelete, id, change.Before, nil)
+	s.record(AuditCreate, newID, nil, change.After)
+	return change.After, nil
+}
+
+// IncrementField atomically adds delta to a numeric field of book id and
+// returns the new value. The result is validated like any other update,
+// under the same write lock, so an out-of-range value is never stored.
+func (s *DefaultBookService) IncrementField(id, field string, delta int) (int, error) {
+	fieldOf, ok := incrementFields[field]
+	if !ok {
+		return 0, fmt.Errorf("%w: field %q cannot be incremented", ErrInvalidBook, field)
+	}
+	change, err := s.repo.UpdateFunc(id, func(book *Book) error {
+		value := fieldOf(book)
+		// Fields are never negative, so an overflow shows up as one too
+		if *value += delta; *value < 0 {
+			return fmt.Errorf("%w: %s would become %d", ErrInvalidBook, field, *value)
+		}
+		return s.validate(book)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.record(AuditUpdate, id, change.Before, change.After)
+	return *incrementFields[field](change.After), nil
+}
+
+// TouchBook marks book id as changed by bumping only its UpdatedAt, for
+// cache invalidation
+func (s *DefaultBookService) TouchBook(id string) (*Book, error) {
+	change, err := s.repo.Touch(id)
+	if err != nil {
+		return nil, err
+	}
+	s.record(AuditUpdate, id, change.Before, change.After)
+	return change.After, nil
+}
+
+// PopBook atomically removes book id and returns it, for consumers that
+// treat the catalog as a queue
+func (s *DefaultBookService) PopBook(id string) (*Book, error) {
+	book, err := s.repo.Pop(id)
+	if err != nil {
+		return nil, err
+	}
+	s.views.remove(id)
+	s.record(AuditDelete, id, book, nil)
+	return book, nil
+}
+
+// fillMissingFields copies every empty field of keep from remove
+func fillMissingFields(keep, remove *Book) {
+	if keep.Title == "" {
+		keep.Title = remove.Title
+	}
+	if keep.Author == "" {
+		keep.Author = remove.Author
+	}
+	if keep.PublishedYear == 0 {
+		keep.PublishedYear = remove.PublishedYear
+	}
+	if keep.ISBN == "" {
+		keep.ISBN = remove.ISBN
+	}
+	if keep.Description == "" {
+		keep.Description = remove.Description
+	}
+	if keep.Genre == "" {
+		keep.Genre = remove.Genre
+	}
+}
+
+// BulkUpdateResult reports the outcome for one ID of a bulk update
+type BulkUpdateResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// BulkUpdateSummary is the response of a bulk update such as categorize
+type BulkUpdateSummary struct {
+	Updated int                `json:"updated"`
+	Failed  int                `json:"failed"`
+	Results []BulkUpdateResult `json:"results"`
+}
+
+// CategorizeBooks sets genre on every listed book. Unknown IDs are reported
+// per ID; when transactional, any unknown ID leaves all books unchanged and
+// the summary is returned together with ErrBookNotFound.
+func (s *DefaultBookService) CategorizeBooks(ids []string, genre string, transactional bool) (*BulkUpdateSummary, error) {
+	genre = strings.TrimSpace(genre)
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: ids is required", ErrInvalidBook)
+	}
+	if genre == "" {
+		return nil, fmt.Errorf("%w: genre is required", ErrInvalidBook)
+	}
+	if hasControlChars(genre, false) {
+		return nil, fmt.Errorf("%w: genre must not contain control characters", ErrInvalidBook)
+	}
+
+	changes, missing, err := s.repo.UpdateMany(ids, transactional, func(book *Book) {
+		book.Genre = genre
+	})
+	if err != nil && !errors.Is(err, ErrBookNotFound) {
+		return nil, err
+	}
+	for _, change := range changes {
+		s.record(AuditUpdate, change.After.ID, change.Before, change.After)
+	}
+
+	notFound := make(map[string]bool, len(missing))
+	for _, id := range missing {
+		notFound[id] = true
+	}
+	summary := &BulkUpdateSummary{Results: make([]BulkUpdateResult, len(ids))}
+	for i, id := range ids {
+		summary.Results[i].ID = id
+		switch {
+		case notFound[id]:
+			summary.Results[i].Error = ErrBookNotFound.Error()
+			summary.Failed++
+		case err != nil:
+			summary.Results[i].Error = "not updated: transaction rolled back"
+			summary.Failed++
+		default:
+			summary.Updated++
+		}
+	}
+	return summary, err
+}
+
+// SetGenreByAuthor sets genre on every book listing author among its
+// authors, ignoring case and surrounding spaces, in one transaction. It
+// returns the number of books updated.
+func (s *DefaultBookService) SetGenreByAuthor(author, genre string) (int, error) {
+	author, genre = strings.TrimSpace(author), strings.TrimSpace(genre)
+	if author == "" {
+		return 0, fmt.Errorf("%w: author is required", ErrInvalidBook)
+	}
+	if genre == "" {
+		return 0, fmt.Errorf("%w: genre is required", ErrInvalidBook)
+	}
+	if hasControlChars(genre, false) {
+		return 0, fmt.Errorf("%w: genre must not contain control characters", ErrInvalidBook)
+	}
+
+	key := authorGroupKey(author)
+	changes, err := s.repo.UpdateWhere(func(book *Book) bool {
+		for _, name := range splitAuthors(book.Author) {
+			if authorGroupKey(name) == key {
+				return true
+			}
+		}
+		return false
+	}, func(book *Book) {
+		book.Genre = genre
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, change := range changes {
+		s.record(AuditUpdate, change.After.ID, change.Before, change.After)
+	}
+	return len(changes), nil
+}
+
+// BulkDeleteSummary is the response of a batch delete
+type BulkDeleteSummary struct {
+	Deleted int                `json:"deleted"`
+	Failed  int                `json:"failed"`
+	Results []BulkUpdateResult `json:"results"`
+}
+
+// DeleteBooks deletes every listed book. Unknown IDs are reported per ID
+// without stopping the others.
+func (s *DefaultBookService) DeleteBooks(ids []string) (*BulkDeleteSummary, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: ids is required", ErrInvalidBook)
+	}
+
+	summary := &BulkDeleteSummary{Results: make([]BulkUpdateResult, len(ids))}
+	for i, id := range ids {
+		summary.Results[i].ID = id
+		err := s.DeleteBook(id)
+		switch {
+		case errors.Is(err, ErrBookNotFound):
+			summary.Results[i].Error = err.Error()
+			summary.Failed++
+		case err != nil:
+			return nil, err
+		default:
+			summary.Deleted++
+		}
+	}
+	return summary, nil
+}
+
+// SearchBooksByAuthor finds books by author
+func (s *DefaultBookService) SearchBooksByAuthor(author string) ([]*Book, error) {
+	return s.SearchBooksByAuthorContext(context.Background(), author)
+}
+
+// SearchBooksByAuthorContext finds books by author, giving up once ctx is done
+func (s *DefaultBookService) SearchBooksByAuthorContext(ctx context.Context, author string) (books []*Book, err error) {
+	ctx, span := startSpan(ctx, "BookService.SearchBooksByAuthor")
+	defer func() { endSpan(span, err) }()
+	return s.repo.SearchByAuthorContext(ctx, author)
+}
+
+// SearchBooksByTitle finds books by title
+func (s *DefaultBookService) SearchBooksByTitle(title string) ([]*Book, error) {
+	return s.SearchBooksByTitleContext(context.Background(), title)
+}
+
+// SearchBooksByTitleContext finds books by title, giving up once ctx is done
+func (s *DefaultBookService) SearchBooksByTitleContext(ctx context.Context, title string) (books []*Book, err error) {
+	ctx, span := startSpan(ctx, "BookService.SearchBooksByTitle")
+	defer func() { endSpan(span, err) }()
+	return s.repo.SearchByTitleContext(ctx, title)
+}
+
+// errCandidateCap stops a fuzzy search once enough books were evaluated
+var errCandidateCap = errors.New("fuzzy search candidate cap reached")
+
+// FuzzySearch finds books whose title or author, depending on field, is
+// within maxDistance edits of term, ignoring case. Matches are ranked by
+// distance, ties in ID order. At most maxCandidates books are evaluated,
+// in ID order (0 means all); truncated reports that the cap cut the scan
+// short.
+func (s *DefaultBookService) FuzzySearch(ctx context.Context, field, term string, maxDistance, maxCandidates int) (books []*Book, truncated bool, err error) {
+	ctx, span := startSpan(ctx, "BookService.FuzzySearch")
+	defer func() { endSpan(span, err) }()
+	var text func(*Book) string
+	switch field {
+	case "title":
+		text = func(b *Book) string { return b.Title }
+	case "author":
+		text = func(b *Book) string { return b.Author }
+	default:
+		return nil, false, fmt.Errorf("%w: fuzzy search applies to title or author, not %q", ErrInvalidBook, field)
+	}
+	if strings.TrimSpace(term) == "" {
+		return nil, false, fmt.Errorf("%w: fuzzy search term must not be empty", ErrInvalidBook)
+	}
+	if maxDistance < 0 {
+		return nil, false, fmt.Errorf("%w: maximum edit distance must not be negative", ErrInvalidBook)
+	}
+
+	query := []rune(strings.ToLower(term))
+	queryWords := len(strings.Fields(string(query)))
+	var distances []int
+	evaluated := 0
+	err = s.repo.ForEach(ctx, func(b *Book) error {
+		if maxCandidates > 0 && evaluated == maxCandidates {
+			truncated = true
+			return errCandidateCap
+		}
+		evaluated++
+		if d := fuzzyDistance(query, queryWords, text(b), maxDistance); d <= maxDistance {
+			books = append(books, b)
+			distances = append(distances, d)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errCandidateCap) {
+		return nil, false, err
+	}
+	ranked := make([]int, len(books))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return distances[ranked[i]] < distances[ranked[j]] })
+	result := make([]*Book, len(books))
+	for i, idx := range ranked {
+		result[i] = books[idx]
+	}
+	return result, truncated, nil
+}
+
+// fuzzyDistance is the smallest edit distance between query, which has
+// queryWords words, and either the whole of text or any run of that many
+// consecutive words in it, so "hobit" finds "The Hobbit". Distances above
+// limit are reported as limit+1.
+func fuzzyDistance(query []rune, queryWords int, text string, limit int) int {
+	text = strings.ToLower(text)
+	best := levenshtein(query, []rune(text), limit)
+	words := strings.Fields(text)
+	for i := 0; i+queryWords <= len(words) && best > 0; i++ {
+		if d := levenshtein(query, []rune(strings.Join(words[i:i+queryWords], " ")), limit); d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between a and b, or limit+1 as
+// soon as it is certain to exceed limit. It keeps two rows of the usual
+// table, so it needs O(len(b)) memory.
+func levenshtein(a, b []rune, limit int) int {
+	if diff := len(a) - len(b); diff > limit || -diff > limit {
+		return limit + 1
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		// Distances never shrink from one row to the next
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return min(prev[len(b)], limit+1)
+}
+
+// SearchBooksByDescription finds books whose description has all words of term
+func (s *DefaultBookService) SearchBooksByDescription(term string) ([]*Book, error) {
+	return s.SearchBooksByDescriptionContext(context.Background(), term)
+}
+
+// SearchBooksByDescriptionContext finds books whose description has all
+// words of term, giving up once ctx is done
+func (s *DefaultBookService) SearchBooksByDescriptionContext(ctx context.Context, term string) (books []*Book, err error) {
+	ctx, span := startSpan(ctx, "BookService.SearchBooksByDescription")
+	defer func() { endSpan(span, err) }()
+	if strings.TrimSpace(term) == "" {
+		return nil, fmt.Errorf("%w: description search term is required", ErrInvalidBook)
+	}
+	return s.repo.SearchByDescriptionContext(ctx, term)
+}
+
+// SearchBooksByISBNPrefix finds books whose ISBN starts with prefix, such as
+// a publisher prefix. Hyphens and spaces are ignored; the rest must be digits.
+func (s *DefaultBookService) SearchBooksByISBNPrefix(prefix string) ([]*Book, error) {
+	return s.SearchBooksByISBNPrefixContext(context.Background(), prefix)
+}
+
+// SearchBooksByISBNPrefixContext finds books whose ISBN starts with prefix,
+// giving up once ctx is done
+func (s *DefaultBookService) SearchBooksByISBNPrefixContext(ctx context.Context, prefix string) (books []*Book, err error) {
+	ctx, span := startSpan(ctx, "BookService.SearchBooksByISBNPrefix")
+	defer func() { endSpan(span, err) }()
+	normalized := normalizeISBN(prefix)
+	if normalized == "" {
+		return nil, fmt.Errorf("%w: isbnPrefix is required", ErrInvalidBook)
+	}
+	for _, c := range normalized {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("%w: isbnPrefix must be numeric, got %q", ErrInvalidBook, prefix)
+		}
+	}
+	return s.repo.SearchByISBNPrefixContext(ctx, normalized)
+}
+
+// maxSearchYear bounds the years SearchBooksByYear accepts
+const maxSearchYear = 9999
+
+// SearchBooksByYear finds books published in exactly year. Unknown (zero)
+// years cannot be searched for; FindIncomplete lists those books.
+func (s *DefaultBookService) SearchBooksByYear(year int) ([]*Book, error) {
+	if year < 1 || year > maxSearchYear {
+		return nil, fmt.Errorf("%w: year must be between 1 and %d, got %d", ErrInvalidBook, maxSearchYear, year)
+	}
+	return s.repo.SearchByYear(year)
+}
+
+// GetBooksByIDRange returns the books whose numeric ID lies between from and
+// to inclusive, ordered by ID. Books with non-numeric IDs are skipped.
+func (s *DefaultBookService) GetBooksByIDRange(from, to int) ([]*Book, error) {
+	if err := checkIDRange(from, to); err != nil {
+		return nil, err
+	}
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return filterBooks(books, func(b *Book) bool { return inIDRange(b.ID, from, to) }), nil
+}
+
+// checkIDRange rejects inverted ID ranges
+func checkIDRange(from, to int) error {
+	if from > to {
+		return fmt.Errorf("%w: idFrom %d must not be greater than idTo %d", ErrInvalidBook, from, to)
+	}
+	return nil
+}
+
+// inIDRange reports whether id is numeric and between from and to inclusive
+func inIDRange(id string, from, to int) bool {
+	n, err := strconv.Atoi(id)
+	return err == nil && n >= from && n <= to
+}
+
+// SearchBooksByGenre finds books of exactly genre, ignoring case
+func (s *DefaultBookService) SearchBooksByGenre(genre string) ([]*Book, error) {
+	if strings.TrimSpace(genre) == "" {
+		return nil, fmt.Errorf("%w: genre is required", ErrInvalidBook)
+	}
+	return s.repo.SearchByGenre(genre)
+}
+
+// GetExtremes returns the books with the lowest and highest known
+// PublishedYear, preferring the smallest ID on ties. Books with an unknown
+// (zero) year are ignored, and both results are nil when none remain.
+func (s *DefaultBookService) GetExtremes() (oldest, newest *Book, err error) {
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	// GetAll is ordered by ID, so strict comparisons keep the smallest ID on ties
+	for _, book := range books {
+		if book.PublishedYear == 0 {
+			continue
+		}
+		if oldest == nil || book.PublishedYear < oldest.PublishedYear {
+			oldest = book
+		}
+		if newest == nil || book.PublishedYear > newest.PublishedYear {
+			newest = book
+		}
+	}
+	return oldest, newest, nil
+}
+
+// DecadeCount is the number of books published in the decade starting at Decade
+type DecadeCount struct {
+	Decade int `json:"decade"`
+	Count  int `json:"count"`
+}
+
+// CountByDecade buckets books by published decade in ascending order,
+// skipping unknown years. With includeEmpty, decades between the first and
+// last bucket that have no books are reported with a zero count.
+func (s *DefaultBookService) CountByDecade(includeEmpty bool) ([]DecadeCount, error) {
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int]int)
+	for _, book := range books {
+		if book.PublishedYear == 0 {
+			continue
+		}
+		counts[book.PublishedYear/10*10]++
+	}
+
+	decades := make([]int, 0, len(counts))
+	for decade := range counts {
+		decades = append(decades, decade)
+	}
+	sort.Ints(decades)
+	if includeEmpty && len(decades) > 0 {
+		first, last := decades[0], decades[len(decades)-1]
+		decades = decades[:0]
+		for decade := first; decade <= last; decade += 10 {
+			decades = append(decades, decade)
+		}
+	}
+
+	buckets := make([]DecadeCount, len(decades))
+	for i, decade := range decades {
+		buckets[i] = DecadeCount{Decade: decade, Count: counts[decade]}
+	}
+	return buckets, nil
+}
+
+// InitialCount is the number of books whose title or author starts with
+// one letter, with their IDs in ID order when asked for
+type InitialCount struct {
+	Count int      `json:"count"`
+	IDs   []string `json:"ids,omitempty"`
+}
+
+// nonLetterInitial buckets titles and authors that do not start with a letter
+const nonLetterInitial = "#"
+
+// IndexByInitial buckets books by the upper-cased first letter of their
+// title or author, for an A-Z navigator. Anything not starting with a
+// letter, such as "1984" or "'Salem's Lot", is under "#".
+func (s *DefaultBookService) IndexByInitial(field string, withIDs bool) (map[string]*InitialCount, error) {
+	var text func(*Book) string
+	switch field {
+	case "title":
+		text = func(b *Book) string { return b.Title }
+	case "author":
+		text = func(b *Book) string { return b.Author }
+	default:
+		return nil, fmt.Errorf("%w: field must be title or author, got %q", ErrInvalidBook, field)
+	}
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]*InitialCount)
+	for _, book := range books {
+		initial := nonLetterInitial
+		if r, _ := utf8.DecodeRuneInString(strings.TrimSpace(text(book))); unicode.IsLetter(r) {
+			initial = string(unicode.ToUpper(r))
+		}
+		bucket := index[initial]
+		if bucket == nil {
+			bucket = &InitialCount{}
+			index[initial] = bucket
+		}
+		bucket.Count++
+		if withIDs {
+			bucket.IDs = append(bucket.IDs, book.ID)
+		}
+	}
+	return index, nil
+}
+
+// GetRecentBooks returns up to limit books, newest CreatedAt first and
+// higher IDs first among books created at the same time
+func (s *DefaultBookService) GetRecentBooks(limit int) ([]*Book, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit must be positive", ErrInvalidBook)
+	}
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		if !books[i].CreatedAt.Equal(books[j].CreatedAt) {
+			return books[i].CreatedAt.After(books[j].CreatedAt)
+		}
+		return lessID(books[j].ID, books[i].ID)
+	})
+	if len(books) > limit {
+		books = books[:limit]
+	}
+	return books, nil
+}
+
+// AuthorCount is the number of books by one author
+type AuthorCount struct {
+	Author string `json:"author"`
+	Count  int    `json:"count"`
+}
+
+// TopAuthors returns up to limit authors with the most books, ties in
+// author order
+func (s *DefaultBookService) TopAuthors(limit int) ([]AuthorCount, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit must be positive", ErrInvalidBook)
+	}
+	counts, err := s.repo.AuthorCounts()
+	if err != nil {
+		return nil, err
+	}
+	authors := make([]AuthorCount, 0, len(counts))
+	for author, n := range counts {
+		authors = append(authors, AuthorCount{Author: author, Count: n})
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		if authors[i].Count != authors[j].Count {
+			return authors[i].Count > authors[j].Count
+		}
+		return authors[i].Author < authors[j].Author
+	})
+	if len(authors) > limit {
+		authors = authors[:limit]
+	}
+	return authors, nil
+}
+
+// viewCounter counts book views in memory; it is safe for concurrent use
+type viewCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{counts: make(map[string]int64)}
+}
+
+// add counts one view of the book with the given ID
+func (c *viewCounter) add(id string) {
+	c.mu.Lock()
+	c.counts[id]++
+	c.mu.Unlock()
+}
+
+// remove drops the count of a deleted book, so a book later stored under
+// the same ID starts from zero
+func (c *viewCounter) remove(id string) {
+	c.mu.Lock()
+	delete(c.counts, id)
+	c.mu.Unlock()
+}
+
+// move carries the count of a book over to the new ID it was reassigned to
+func (c *viewCounter) move(from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.counts[from]; ok {
+		c.counts[to] = n
+		delete(c.counts, from)
+	}
+}
+
+// snapshot returns a copy of the counts
+func (c *viewCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for id, n := range c.counts {
+		counts[id] = n
+	}
+	return counts
+}
+
+// BookViews is a book with the number of times it was fetched by ID
+type BookViews struct {
+	Views int64 `json:"views"`
+	Book  *Book `json:"book"`
+}
+
+// BookHistory returns the book id with its audit history. A deleted book
+// with history is returned as a tombstone; a book with neither is
+// ErrBookNotFound. Without a file audit log it is ErrHistoryUnavailable.
+func (s *DefaultBookService) BookHistory(id string) (*BookWithHistory, error) {
+	if s.audit == nil {
+		return nil, ErrHistoryUnavailable
+	}
+	book, err := s.repo.GetByID(id)
+	if err != nil && !errors.Is(err, ErrBookNotFound) {
+		return nil, err
+	}
+	history, herr := s.audit.History(id)
+	if herr != nil {
+		return nil, herr
+	}
+	if err != nil {
+		last := len(history) - 1
+		if last < 0 || history[last].Op != AuditDelete {
+			return nil, err
+		}
+		return &BookWithHistory{
+			Tombstone: &Tombstone{ID: id, Deleted: true, DeletedAt: history[last].Timestamp},
+			History:   history,
+		}, nil
+	}
+	return &BookWithHistory{Book: book, History: history}, nil
+}
+
+// PopularBooks returns up to limit books with the most views since the
+// service started, ties in ID order. Deleting a book drops its views and
+// reassigning it keeps them. Reading them here does not count as a view.
+func (s *DefaultBookService) PopularBooks(limit int) ([]BookViews, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit must be positive", ErrInvalidBook)
+	}
+	counts := s.views.snapshot()
+	ids := make([]string, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if counts[ids[i]] != counts[ids[j]] {
+			return counts[ids[i]] > counts[ids[j]]
+		}
+		return lessID(ids[i], ids[j])
+	})
+	popular := make([]BookViews, 0, limit)
+	for _, id := range ids {
+		if len(popular) == limit {
+			break
+		}
+		book, err := s.repo.GetByID(id)
+		if errors.Is(err, ErrBookNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		popular = append(popular, BookViews{Views: counts[id], Book: book})
+	}
+	return popular, nil
+}
+
+// Changes returns up to limit changes made after the since token; an empty
+// token returns no changes and the token to follow later ones from
+func (s *DefaultBookService) Changes(since string, limit int) (*ChangeFeed, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: limit must be positive", ErrInvalidBook)
+	}
+	return s.repo.Changes(since, limit)
+}
+
+// ISBNEntry pairs a normalized ISBN with the ID of a book carrying it
+type ISBNEntry struct {
+	ISBN string `json:"isbn"`
+	ID   string `json:"id"`
+}
+
+// ListISBNs returns every ISBN in the catalog with its book, ordered by
+// ISBN and then ID. An ISBN shared by several books appears once per book.
+func (s *DefaultBookService) ListISBNs() ([]ISBNEntry, error) {
+	isbns, err := s.repo.ISBNs()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ISBNEntry, 0, len(isbns))
+	for isbn, ids := range isbns {
+		for _, id := range ids {
+			entries = append(entries, ISBNEntry{ISBN: isbn, ID: id})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ISBN != entries[j].ISBN {
+			return entries[i].ISBN < entries[j].ISBN
+		}
+		return lessID(entries[i].ID, entries[j].ID)
+	})
+	return entries, nil
+}
+
+// AuthorGroup lists the books of one author. Count is the author's total
+// number of books, which exceeds len(Books) when the books are capped.
+type AuthorGroup struct {
+	Author string  `json:"author"`
+	Count  int     `json:"count"`
+	Books  []*Book `json:"books"`
+}
+
+// GroupByAuthor groups books by author under their authorGroupKey, so case
+// and surrounding spaces are ignored; a book with several authors joins
+// each of their groups. It returns the page of limit groups starting at
+// offset along with the total number of authors. Groups are ordered by
+// author; each keeps at most perAuthor books (0 for all), ordered by ID.
+func (s *DefaultBookService) GroupByAuthor(offset, limit, perAuthor int) ([]AuthorGroup, int, error) {
+	if offset < 0 || limit <= 0 || perAuthor < 0 {
+		return nil, 0, fmt.Errorf("%w: offset and perAuthor must not be negative and limit must be positive", ErrInvalidBook)
+	}
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// GetAll is ordered by ID, so each group's first book names the author
+	byKey := make(map[string]*AuthorGroup)
+	var keys []string
+	for _, book := range books {
+		for _, name := range splitAuthors(book.Author) {
+			key := authorGroupKey(name)
+			group, ok := byKey[key]
+			if !ok {
+				group = &AuthorGroup{Author: name}
+				byKey[key] = group
+				keys = append(keys, key)
+			}
+			group.Count++
+			if perAuthor == 0 || len(group.Books) < perAuthor {
+				group.Books = append(group.Books, book)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	total := len(keys)
+	if offset > total {
+		offset = total
+	}
+	keys = keys[offset:]
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	groups := make([]AuthorGroup, len(keys))
+	for i, key := range keys {
+		groups[i] = *byKey[key]
+	}
+	return groups, total, nil
+}
+
+// Metadata fields FindIncomplete can check for
+const (
+	MissingISBN        = "isbn"
+	MissingYear        = "year"
+	MissingDescription = "description"
+)
+
+// incompleteChecks reports for each metadata field whether a book lacks it
+var incompleteChecks = map[string]func(*Book) bool{
+	MissingISBN:        func(b *Book) bool { return strings.TrimSpace(b.ISBN) == "" },
+	MissingYear:        func(b *Book) bool { return b.PublishedYear == 0 },
+	MissingDescription: func(b *Book) bool { return strings.TrimSpace(b.Description) == "" },
+}
+
+// FindIncomplete returns the books, ordered by ID, that lack any of the
+// given metadata fields; no fields means all of them
+func (s *DefaultBookService) FindIncomplete(missing []string) ([]*Book, error) {
+	if len(missing) == 0 {
+		missing = []string{MissingISBN, MissingYear, MissingDescription}
+	}
+	checks := make([]func(*Book) bool, len(missing))
+	for i, field := range missing {
+		check, ok := incompleteChecks[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing must list %s, %s or %s, got %q",
+				ErrInvalidBook, MissingISBN, MissingYear, MissingDescription, field)
+		}
+		checks[i] = check
+	}
+
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return filterBooks(books, func(b *Book) bool {
+		for _, check := range checks {
+			if check(b) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// qualityFields are the recommended fields the quality score checks, in
+// report order, each with a test for whether a book lacks it
+var qualityFields = []struct {
+	name    string
+	missing func(*Book) bool
+}{
+	{MissingISBN, incompleteChecks[MissingISBN]},
+	{MissingYear, incompleteChecks[MissingYear]},
+	{MissingDescription, incompleteChecks[MissingDescription]},
+	{"genre", func(b *Book) bool { return strings.TrimSpace(b.Genre) == "" }},
+}
+
+// FieldCompleteness is how many books have one recommended field
+type FieldCompleteness struct {
+	Populated int     `json:"populated"`
+	Percent   float64 `json:"percent"`
+}
+
+// QualityReport scores catalog completeness from 0 to 100: the percentage
+// of books with every recommended field, broken down per field
+type QualityReport struct {
+	Books    int                          `json:"books"`
+	Complete int                          `json:"complete"`
+	Score    float64                      `json:"score"`
+	Fields   map[string]FieldCompleteness `json:"fields"`
+}
+
+// Quality computes the QualityReport over all books. An empty catalog
+// scores 100, as no book lacks anything.
+func (s *DefaultBookService) Quality() (*QualityReport, error) {
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	populated := make([]int, len(qualityFields))
+	report := &QualityReport{Books: len(books), Fields: make(map[string]FieldCompleteness, len(qualityFields))}
+	for _, book := range books {
+		complete := true
+		for i, field := range qualityFields {
+			if field.missing(book) {
+				complete = false
+			} else {
+				populated[i]++
+			}
+		}
+		if complete {
+			report.Complete++
+		}
+	}
+	report.Score = percentOf(report.Complete, report.Books)
+	for i, field := range qualityFields {
+		report.Fields[field.name] = FieldCompleteness{Populated: populated[i], Percent: percentOf(populated[i], report.Books)}
+	}
+	return report, nil
+}
+
+// percentOf is n as a percentage of total, rounded to two decimals; 100
+// when total is zero
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return math.Round(float64(n)*10000/float64(total)) / 100
+}
+
+// Keys for grouping likely duplicates
+const (
+	DuplicatesByISBN        = "isbn"
+	DuplicatesByTitleAuthor = "title-author"
+)
+
+// DuplicateCluster is a group of books sharing the same duplicate key
+type DuplicateCluster struct {
+	Key   string  `json:"key"`
+	Books []*Book `json:"books"`
+}
+
+// FindDuplicates groups books by normalized ISBN or by normalized title and
+// author, returning only groups with more than one book, ordered by key
+func (s *DefaultBookService) FindDuplicates(by string) ([]DuplicateCluster, error) {
+	var keyOf func(*Book) string
+	switch by {
+	case DuplicatesByISBN:
+		keyOf = func(b *Book) string { return normalizeISBN(b.ISBN) }
+	case DuplicatesByTitleAuthor:
+		keyOf = func(b *Book) string {
+			title, author := normalizeName(b.Title), normalizeName(b.Author)
+			if title == "" || author == "" {
+				return ""
+			}
+			return title + "|" + author
+		}
+	default:
+		return nil, fmt.Errorf("%w: by must be %s or %s", ErrInvalidBook, DuplicatesByISBN, DuplicatesByTitleAuthor)
+	}
+
+	books, err := s.repo.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]*Book)
+	for _, book := range books {
+		if key := keyOf(book); key != "" {
+			groups[key] = append(groups[key], book)
+		}
+	}
+
+	clusters := make([]DuplicateCluster, 0)
+	for key, group := range groups {
+		if len(group) > 1 {
+			clusters = append(clusters, DuplicateCluster{Key: key, Books: group})
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Key < clusters[j].Key })
+	return clusters, nil
+}
+
+// ValidateBook runs the validation rules without storing anything
+func (s *DefaultBookService) ValidateBook(book *Book) error {
+	return s.validate(book)
+}
+
+// FieldError describes a validation failure on a single field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a book that failed validation.
+// It matches ErrInvalidBook with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+// Error joins the field failures into one message
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return ErrInvalidBook.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+// Unwrap makes a ValidationError match ErrInvalidBook
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidBook
+}
+
+// add records a failure on field
+func (e *ValidationError) add(field, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// validateBook checks every rule and reports all failing fields at once
+func validateBook(book *Book) error {
+	verr := &ValidationError{}
+	if book == nil {
+		verr.add("book", "is required")
+		return verr
+	}
+	if strings.TrimSpace(book.Title) == "" {
+		verr.add("title", "is required")
+	}
+	if strings.TrimSpace(book.Author) == "" {
+		verr.add("author", "is required")
+	}
+	if book.PublishedYear < 0 {
+		verr.add("publishedYear", "must not be negative")
+	}
+	if hasControlChars(book.Title, false) {
+		verr.add("title", "must not contain control characters")
+	}
+	if hasControlChars(book.Author, false) {
+		verr.add("author", "must not contain control characters")
+	}
+	if hasControlChars(book.Description, true) {
+		verr.add("description", "must not contain control characters")
+	}
+	if hasControlChars(book.Genre, false) {
+		verr.add("genre", "must not contain control characters")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// hasControlChars reports whether s contains a control character such as
+// NUL. Newlines and tabs are tolerated when multiline is set.
+func hasControlChars(s string, multiline bool) bool {
+	for _, c := range s {
+		if multiline && (c == '\n' || c == '\r' || c == '\t') {
+			continue
+		}
+		if unicode.IsControl(c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package bookapi
+
+import "net/http/httptest"
+
+// NewTestServer starts an httptest.Server serving the API from a fresh
+// in-memory repository, returned alongside it for assertions.
+// Callers must Close the server.
+func NewTestServer() (*httptest.Server, BookRepository) {
+	repo := NewInMemoryBookRepository()
+	service := NewBookService(repo)
+	handler := NewBookHandler(service)
+	return httptest.NewServer(NewRouter(handler)), repo
+}
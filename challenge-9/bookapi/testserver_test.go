@@ -0,0 +1,63 @@
+package bookapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"bookapi"
+)
+
+func TestNewTestServerCRUD(t *testing.T) {
+	server, repo := bookapi.NewTestServer()
+	defer server.Close()
+
+	// Create
+	bookJSON, _ := json.Marshal(&bookapi.Book{Title: "Go in Action", Author: "William Kennedy", PublishedYear: 2015})
+	resp, err := http.Post(fmt.Sprintf("%s/api/books", server.URL), "application/json", bytes.NewBuffer(bookJSON))
+	if err != nil {
+		t.Fatalf("Failed to make POST request: %v", err)
+	}
+	var created bookapi.Book
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if stored, err := repo.GetByID(created.ID); err != nil || stored.Title != "Go in Action" {
+		t.Fatalf("Expected the repository to hold the created book; got %v, %v", stored, err)
+	}
+
+	// Read
+	resp, err = http.Get(fmt.Sprintf("%s/api/books/%s", server.URL, created.ID))
+	if err != nil {
+		t.Fatalf("Failed to make GET request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status OK; got %v", resp.Status)
+	}
+
+	// Update
+	created.Description = "An introduction to Go"
+	bookJSON, _ = json.Marshal(created)
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/books/%s", server.URL, created.ID), bytes.NewBuffer(bookJSON))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make PUT request: %v", err)
+	}
+	resp.Body.Close()
+	if stored, _ := repo.GetByID(created.ID); stored.Description != "An introduction to Go" {
+		t.Errorf("Expected the repository to hold the update; got %q", stored.Description)
+	}
+
+	// Delete
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/books/%s", server.URL, created.ID), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make DELETE request: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := repo.GetByID(created.ID); err != bookapi.ErrBookNotFound {
+		t.Errorf("Expected the book to be deleted from the repository; got %v", err)
+	}
+}